@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+/*
+	The admin API adds and removes clusters while we're running:
+
+	GET    /admin/clusters         every running cluster and where it came from
+	POST   /admin/clusters         start a cluster, the body is the same as an entry under clusters: in the config file
+	DELETE /admin/clusters/{name}  stop a cluster and drop its data
+
+	Clusters added here only live until the next restart, put them in the config file to keep them.
+	Hub clusters belong to their Secrets so they can't be removed here. There's no auth on any of
+	this, which is ok for now since serve() only listens on localhost unless -listen says
+	otherwise. What has to be reachable from outside the pod (/healthz, /readyz and /metrics)
+	is on the separate -probe-listen listener, which doesn't serve any of this.
+*/
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func registerAdminHandlers(ctx context.Context, mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/clusters", listClusters)
+	mux.HandleFunc("POST /admin/clusters", func(writer http.ResponseWriter, req *http.Request) {
+		// the cluster has to outlive the request, so it gets the process' context
+		addCluster(ctx, writer, req)
+	})
+	mux.HandleFunc("DELETE /admin/clusters/{name}", removeCluster)
+}
+
+func listClusters(writer http.ResponseWriter, req *http.Request) {
+	writeJSON(writer, http.StatusOK, Controllers.statuses())
+}
+
+func addCluster(ctx context.Context, writer http.ResponseWriter, req *http.Request) {
+	var config ClusterConfig
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid cluster: %s", err.Error())})
+		return
+	}
+
+	if err := validateClusterConfigs([]ClusterConfig{config}); err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	if existing, exists := Controllers.get(config.Name); exists {
+		writeJSON(writer, http.StatusConflict, apiError{Error: fmt.Sprintf("there's already a cluster called %s (from %s)", config.Name, existing.source)})
+		return
+	}
+
+	if err := Controllers.start(ctx, config, sourceAPI); err != nil {
+		status := http.StatusInternalServerError
+		if strings.HasPrefix(err.Error(), "there's already a cluster") {
+			status = http.StatusConflict
+		}
+		writeJSON(writer, status, apiError{Error: err.Error()})
+		return
+	}
+
+	klog.InfoS("Cluster added through the admin API", "cluster", config.Name)
+	writeJSON(writer, http.StatusCreated, ClusterStatus{
+		Name:       config.Name,
+		Source:     sourceAPI,
+		Kubeconfig: config.Kubeconfig,
+		Context:    config.Context,
+		Namespaces: config.Namespaces,
+		Labels:     config.Labels,
+	})
+}
+
+func removeCluster(writer http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	cluster, exists := Controllers.get(name)
+	if !exists {
+		writeJSON(writer, http.StatusNotFound, apiError{Error: fmt.Sprintf("there's no cluster called %s", name)})
+		return
+	}
+	if cluster.source == sourceHub {
+		writeJSON(writer, http.StatusConflict, apiError{Error: fmt.Sprintf("cluster %s comes from a hub Secret, delete the Secret instead", name)})
+		return
+	}
+
+	Controllers.remove(name)
+	klog.InfoS("Cluster removed through the admin API", "cluster", name, "source", cluster.source)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		fmt.Printf("Error while marshaling response! Error: %s\n", err.Error())
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(data)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	/ sends everything every time, which is fine for the table but not for anything that wants
+	one cluster or one service. /api/v1 is the same data as resources:
+
+	GET /api/v1/clusters                    every cluster (and git source) with its status
+	GET /api/v1/clusters/{name}             one of them
+	GET /api/v1/clusters/{name}/workloads   its workloads
+	GET /api/v1/services                    every service, with where it runs in each cluster
+	GET /api/v1/services/{name}             one service, e.g. /api/v1/services/default/api
+	GET /api/v1/watch                       changes as they happen, see watch.go
+
+	The workload and service lists take namespace=, kind= and image= (a substring of any of the
+	containers' images) to filter, and cluster= for services. Lists are paged with limit= (100
+	if it's left out, at most 1000) and offset=, and come back as {items, total, offset, limit}.
+	Errors are {"error": "..."} with a 4xx or 5xx status, like the rest of the API.
+*/
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// APICluster is a cluster's status and how many workloads it has
+type APICluster struct {
+	ClusterStatus
+	Workloads int `json:"workloads"`
+}
+
+// APIService is a service and its workload in every cluster it runs in
+type APIService struct {
+	Service   string            `json:"service"`
+	Instances []ServiceInstance `json:"instances"`
+}
+
+type ServiceInstance struct {
+	Cluster string `json:"cluster"`
+	ServiceInfo
+}
+
+type Page[T any] struct {
+	Items  []T `json:"items"`
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// workloadFilter is the query parameters that narrow a list of workloads down
+type workloadFilter struct {
+	Cluster   string
+	Namespace string
+	Kind      string
+	Image     string
+}
+
+func registerAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/clusters", listAPIClusters)
+	mux.HandleFunc("GET /api/v1/clusters/{name}", getAPICluster)
+	mux.HandleFunc("GET /api/v1/clusters/{name}/workloads", listAPIWorkloads)
+	mux.HandleFunc("GET /api/v1/services", listAPIServices)
+	mux.HandleFunc("GET /api/v1/services/{name...}", getAPIService)
+	mux.HandleFunc("GET /api/v1/watch", watchAPI)
+	// so anything else under /api/v1 gets a JSON error too instead of falling through to /
+	mux.HandleFunc("/api/v1/", func(writer http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writer.Header().Set("Allow", http.MethodGet)
+			writeJSON(writer, http.StatusMethodNotAllowed, apiError{Error: fmt.Sprintf("%s isn't allowed, the API is read only", req.Method)})
+			return
+		}
+		writeJSON(writer, http.StatusNotFound, apiError{Error: fmt.Sprintf("there's nothing at %s", req.URL.Path)})
+	})
+}
+
+func listAPIClusters(writer http.ResponseWriter, req *http.Request) {
+	clusters := apiClusters()
+	page, err := paginate(req, clusters)
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(writer, http.StatusOK, page)
+}
+
+func getAPICluster(writer http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	for _, cluster := range apiClusters() {
+		if cluster.Name == name {
+			writeJSON(writer, http.StatusOK, cluster)
+			return
+		}
+	}
+	writeJSON(writer, http.StatusNotFound, apiError{Error: fmt.Sprintf("there's no cluster called %s", name)})
+}
+
+func listAPIWorkloads(writer http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	for _, cluster := range clusterInfos(Controllers.snapshot(), time.Now()) {
+		if cluster.ClusterName != name {
+			continue
+		}
+		filter := newWorkloadFilter(req)
+		workloads := []ServiceInfo{}
+		for _, workload := range cluster.Services {
+			if filter.matches(name, workload) {
+				workloads = append(workloads, workload)
+			}
+		}
+		page, err := paginate(req, workloads)
+		if err != nil {
+			writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+			return
+		}
+		writeJSON(writer, http.StatusOK, page)
+		return
+	}
+	writeJSON(writer, http.StatusNotFound, apiError{Error: fmt.Sprintf("there's no cluster called %s", name)})
+}
+
+func listAPIServices(writer http.ResponseWriter, req *http.Request) {
+	filter := newWorkloadFilter(req)
+	services := []APIService{}
+	for _, service := range apiServices() {
+		instances := []ServiceInstance{}
+		for _, instance := range service.Instances {
+			if filter.matches(instance.Cluster, instance.ServiceInfo) {
+				instances = append(instances, instance)
+			}
+		}
+		if len(instances) > 0 {
+			services = append(services, APIService{Service: service.Service, Instances: instances})
+		}
+	}
+	page, err := paginate(req, services)
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(writer, http.StatusOK, page)
+}
+
+func getAPIService(writer http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	for _, service := range apiServices() {
+		if service.Service == name {
+			writeJSON(writer, http.StatusOK, service)
+			return
+		}
+	}
+	writeJSON(writer, http.StatusNotFound, apiError{Error: "no service called " + name})
+}
+
+func apiClusters() []APICluster {
+	counts := make(map[string]int)
+	for _, snapshot := range Controllers.snapshot() {
+		counts[snapshot.ClusterName] = len(snapshot.Workloads)
+	}
+	clusters := []APICluster{}
+	for _, status := range Controllers.statuses() {
+		clusters = append(clusters, APICluster{ClusterStatus: status, Workloads: counts[status.Name]})
+	}
+	return clusters
+}
+
+// apiServices is every service sorted by key, with its instances in cluster order
+func apiServices() []APIService {
+	byService := make(map[string]*APIService)
+	var keys []string
+	for _, cluster := range clusterInfos(Controllers.snapshot(), time.Now()) {
+		for _, workload := range cluster.Services {
+			service, exists := byService[workload.Service]
+			if !exists {
+				service = &APIService{Service: workload.Service}
+				byService[workload.Service] = service
+				keys = append(keys, workload.Service)
+			}
+			service.Instances = append(service.Instances, ServiceInstance{Cluster: cluster.ClusterName, ServiceInfo: workload})
+		}
+	}
+	sort.Strings(keys)
+	services := make([]APIService, 0, len(keys))
+	for _, key := range keys {
+		services = append(services, *byService[key])
+	}
+	return services
+}
+
+func newWorkloadFilter(req *http.Request) workloadFilter {
+	query := req.URL.Query()
+	return workloadFilter{
+		Cluster:   query.Get("cluster"),
+		Namespace: query.Get("namespace"),
+		Kind:      query.Get("kind"),
+		Image:     query.Get("image"),
+	}
+}
+
+func (filter workloadFilter) matches(cluster string, workload ServiceInfo) bool {
+	if (filter.Cluster != "" && filter.Cluster != cluster) ||
+		(filter.Namespace != "" && filter.Namespace != workload.Namespace) ||
+		(filter.Kind != "" && !strings.EqualFold(filter.Kind, workload.Kind)) {
+		return false
+	}
+	if filter.Image == "" {
+		return true
+	}
+	for _, container := range workload.Containers {
+		if strings.Contains(container.Image, filter.Image) || strings.Contains(container.Canonical, filter.Image) {
+			return true
+		}
+	}
+	return false
+}
+
+// paginate is the page of items that limit= and offset= ask for
+func paginate[T any](req *http.Request, items []T) (Page[T], error) {
+	query := req.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultPageLimit)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return Page[T]{}, fmt.Errorf("limit has to be a number from 1 to %d", maxPageLimit)
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		return Page[T]{}, fmt.Errorf("offset has to be a number from 0 up")
+	}
+
+	page := Page[T]{Items: []T{}, Total: len(items), Offset: offset, Limit: limit}
+	if offset < len(items) {
+		page.Items = items[offset:min(offset+limit, len(items))]
+	}
+	return page, nil
+}
+
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
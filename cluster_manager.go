@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// where a cluster came from, so a source only ever stops the clusters it started
+const (
+	sourceConfig = "config"
+	sourceHub    = "hub"
+	sourceAPI    = "api"
+)
+
+/*
+	The controllers used to go into a plain map once in main() and never change. Now that
+	clusters can show up and go away while we're running (hub secrets, the admin API and
+	edits to the config file) every
+	controller gets its own context so it can be cancelled on its own, and the map is
+	behind a lock since the HTTP handler reads it while the sources write to it.
+
+	Clusters aren't the only thing in the map anymore, anything that's a Source (see
+	source.go) can be, and what they send is kept here for everything else to read.
+*/
+
+type managedCluster struct {
+	source      string
+	fingerprint string
+	// the parts of its status that come from its config, like the kubeconfig and labels
+	base ClusterStatus
+	// what the source has sent so far
+	workloads *WorkloadStore
+	// unix nanoseconds of the last change the source sent, 0 if it hasn't sent any
+	lastEvent atomic.Int64
+	health    clusterHealth
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// the source of the current attempt (nil until one could be built) and a channel that's
+	// closed once it has caught up, both start over when the source is retried
+	inventory Source
+	synced    chan struct{}
+	mutx      sync.Mutex
+}
+
+func (cluster *managedCluster) current() (Source, chan struct{}) {
+	cluster.mutx.Lock()
+	defer cluster.mutx.Unlock()
+	return cluster.inventory, cluster.synced
+}
+
+func (cluster *managedCluster) isSynced() bool {
+	_, synced := cluster.current()
+	return isClosed(synced)
+}
+
+// ClusterStatus is what the admin API shows for each running cluster
+type ClusterStatus struct {
+	Name       string            `json:"name"`
+	Source     string            `json:"source"`
+	Kubeconfig string            `json:"kubeconfig,omitempty"`
+	Context    string            `json:"context,omitempty"`
+	Namespaces []string          `json:"namespaces,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// where a git source reads its manifests from
+	Path string `json:"path,omitempty"`
+	Ref  string `json:"ref,omitempty"`
+	// the source has sent everything it had when it started
+	Synced bool `json:"synced"`
+	// when the source last sent a change
+	LastEvent *time.Time `json:"lastEvent,omitempty"`
+	// how it's doing, see health.go
+	State              string     `json:"state"`
+	Connected          bool       `json:"connected"`
+	LastSuccessfulList *time.Time `json:"lastSuccessfulList,omitempty"`
+	LastError          string     `json:"lastError,omitempty"`
+	LastErrorTime      *time.Time `json:"lastErrorTime,omitempty"`
+	ServerVersion      string     `json:"serverVersion,omitempty"`
+	// when an unavailable cluster is tried again
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+}
+
+type ClusterManager struct {
+	clusters map[string]*managedCluster
+	mutx     sync.RWMutex
+	wg       sync.WaitGroup
+	// every cluster in the config has been started
+	startedUp bool
+}
+
+func newClusterManager() *ClusterManager {
+	return &ClusterManager{clusters: make(map[string]*managedCluster)}
+}
+
+// start builds a client and a controller for the cluster and runs it until ctx is done or
+// the cluster gets stopped, retrying in the background when it can't. Names have to be unique
+// across every source.
+func (manager *ClusterManager) start(ctx context.Context, config ClusterConfig, source string) error {
+	base := ClusterStatus{Kubeconfig: config.Kubeconfig, Context: config.Context, Namespaces: config.Namespaces, Labels: config.Labels}
+	// the controller's informers are tied to the context it's built with, so it's made in add
+	return manager.add(ctx, config.Name, source, clusterFingerprint(config), base, func(clusterCtx context.Context) (Source, error) {
+		restConfig, err := config.restConfig()
+		if err != nil {
+			return nil, fmt.Errorf("building client config for cluster %s: %w", config.Name, err)
+		}
+		kclient, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("building client for cluster %s: %w", config.Name, err)
+		}
+		dclient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("building dynamic client for cluster %s: %w", config.Name, err)
+		}
+		return NewController(clusterCtx, kclient, dclient, config), nil
+	})
+}
+
+// startGit reads the git source every interval until ctx is done
+func (manager *ClusterManager) startGit(ctx context.Context, config GitSourceConfig) error {
+	base := ClusterStatus{Path: config.Path, Ref: config.Ref, Labels: config.Labels}
+	return manager.add(ctx, config.Name, sourceGit, gitFingerprint(config), base, func(context.Context) (Source, error) {
+		return newGitSource(config), nil
+	})
+}
+
+// add runs the source made by build until ctx is done or it gets stopped, and keeps what it
+// sends. When the source can't be built or stops with an error the cluster is unavailable
+// until a retry works, see retryBackoff.
+func (manager *ClusterManager) add(ctx context.Context, name, source, fingerprint string, base ClusterStatus, build func(context.Context) (Source, error)) error {
+	manager.mutx.Lock()
+	defer manager.mutx.Unlock()
+	if existing, exists := manager.clusters[name]; exists {
+		return fmt.Errorf("there's already a cluster called %s (from %s)", name, existing.source)
+	}
+
+	clusterCtx, cancel := context.WithCancel(ctx)
+	cluster := &managedCluster{
+		source:      source,
+		fingerprint: fingerprint,
+		base:        base,
+		workloads:   newWorkloadStore(),
+		synced:      make(chan struct{}),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	manager.clusters[name] = cluster
+
+	msg := fmt.Sprintf("Invoking controller %s", name)
+	klog.InfoS(msg, "source", source)
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+		defer close(cluster.done)
+		defer cancel()
+		backoff := retryBackoff()
+		for {
+			err := manager.attempt(clusterCtx, name, cluster, build)
+			// being stopped before the caches synced isn't a failure
+			if clusterCtx.Err() != nil || err == nil {
+				return
+			}
+			if cluster.isSynced() {
+				// it worked for a while, so start over from the shortest wait
+				backoff = retryBackoff()
+			}
+			delay := backoff.Step()
+			utilruntime.HandleError(fmt.Errorf("cluster %s is unavailable, retrying in %s: %w", name, delay.Round(time.Second), err))
+			if !cluster.health.stopped(err, time.Now(), time.Now().Add(delay)) {
+				watchEvents.publish(WatchEvent{Type: watchClusterUnreachable, Cluster: name, Error: err.Error()})
+			}
+			// what it had can't be trusted anymore, it gets sent again once it's back
+			cluster.workloads.replace(make(map[WorkloadKey]DeployConfigs))
+			workqueueMetrics.forget(name)
+
+			select {
+			case <-clusterCtx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// retryBackoff is how long to wait before retrying a cluster: 1s doubling up to 5m
+func retryBackoff() wait.Backoff {
+	return wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: math.MaxInt32, Cap: 5 * time.Minute}
+}
+
+// attempt builds the source and runs it once, it returns when the source stops
+func (manager *ClusterManager) attempt(clusterCtx context.Context, name string, cluster *managedCluster, build func(context.Context) (Source, error)) error {
+	ctx, cancel := context.WithCancel(clusterCtx)
+	defer cancel()
+	inventory, err := build(ctx)
+	if err != nil {
+		return err
+	}
+
+	synced := make(chan struct{})
+	cluster.mutx.Lock()
+	cluster.inventory, cluster.synced = inventory, synced
+	cluster.mutx.Unlock()
+	cluster.health.retrying()
+
+	events := make(chan InventoryEvent, 100)
+	go applyEvents(ctx, name, events, cluster, synced)
+	err = inventory.Run(ctx, events)
+	cancel()
+	if inventory, ok := inventory.(shutdowner); ok {
+		inventory.shutdown()
+	}
+	return err
+}
+
+// stop cancels the cluster's controller, waits for it to wind down and drops its data.
+// It returns false if there was no such cluster.
+func (manager *ClusterManager) stop(name string) bool {
+	manager.mutx.Lock()
+	cluster, exists := manager.clusters[name]
+	manager.mutx.Unlock()
+	if !exists {
+		return false
+	}
+
+	cluster.cancel()
+	<-cluster.done
+	manager.forget(name, cluster)
+	klog.InfoS("Stopped controller", "controller", name, "source", cluster.source)
+	return true
+}
+
+// remove stops the cluster for good, unlike a restart it also drops its version history
+func (manager *ClusterManager) remove(name string) bool {
+	if !manager.stop(name) {
+		return false
+	}
+	if _, restarted := manager.get(name); !restarted {
+		versionHistory.forgetCluster(name)
+	}
+	return true
+}
+
+// forget removes the cluster, but only if it's still the same one (it might have been restarted)
+func (manager *ClusterManager) forget(name string, cluster *managedCluster) {
+	manager.mutx.Lock()
+	defer manager.mutx.Unlock()
+	if manager.clusters[name] != cluster {
+		return
+	}
+	delete(manager.clusters, name)
+	watchEvents.publish(WatchEvent{Type: watchClusterRemoved, Cluster: name})
+	workqueueMetrics.forget(name)
+}
+
+func (manager *ClusterManager) get(name string) (*managedCluster, bool) {
+	manager.mutx.RLock()
+	defer manager.mutx.RUnlock()
+	cluster, exists := manager.clusters[name]
+	return cluster, exists
+}
+
+// controllers is a copy of the current controllers so callers can range over it without holding the lock
+func (manager *ClusterManager) controllers() map[string]*Controller {
+	manager.mutx.RLock()
+	defer manager.mutx.RUnlock()
+	controllers := make(map[string]*Controller, len(manager.clusters))
+	for name, cluster := range manager.clusters {
+		inventory, _ := cluster.current()
+		if controller, ok := inventory.(*Controller); ok {
+			controllers[name] = controller
+		}
+	}
+	return controllers
+}
+
+// snapshot copies every cluster's workloads, sorted by cluster name. Unavailable clusters are
+// in it with their state and error but no workloads, what they had might be stale or half of it.
+func (manager *ClusterManager) snapshot() []ClusterSnapshot {
+	manager.mutx.RLock()
+	defer manager.mutx.RUnlock()
+	snapshots := make([]ClusterSnapshot, 0, len(manager.clusters))
+	for name, cluster := range manager.clusters {
+		status := ClusterStatus{Synced: cluster.isSynced()}
+		cluster.health.fill(&status)
+		snapshot := ClusterSnapshot{
+			ClusterName: name,
+			Labels:      cluster.base.Labels,
+			Workloads:   make(map[WorkloadKey]DeployConfigs),
+			State:       status.State,
+			LastError:   status.LastError,
+		}
+		if status.State != clusterUnavailable {
+			snapshot.Workloads = cluster.workloads.snapshot()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ClusterName < snapshots[j].ClusterName })
+	return snapshots
+}
+
+// bySource is the name and fingerprint of every cluster a source started
+func (manager *ClusterManager) bySource(source string) map[string]string {
+	manager.mutx.RLock()
+	defer manager.mutx.RUnlock()
+	fingerprints := make(map[string]string)
+	for name, cluster := range manager.clusters {
+		if cluster.source == source {
+			fingerprints[name] = cluster.fingerprint
+		}
+	}
+	return fingerprints
+}
+
+func (manager *ClusterManager) statuses() []ClusterStatus {
+	manager.mutx.RLock()
+	defer manager.mutx.RUnlock()
+	statuses := make([]ClusterStatus, 0, len(manager.clusters))
+	for name, cluster := range manager.clusters {
+		status := cluster.base
+		status.Name, status.Source, status.Synced = name, cluster.source, cluster.isSynced()
+		if lastEvent := cluster.lastEvent.Load(); lastEvent > 0 {
+			at := time.Unix(0, lastEvent)
+			status.LastEvent = &at
+		}
+		cluster.health.fill(&status)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// doneStartingUp means every cluster in the config has been started, /readyz waits for it
+func (manager *ClusterManager) doneStartingUp() {
+	manager.mutx.Lock()
+	defer manager.mutx.Unlock()
+	manager.startedUp = true
+}
+
+func (manager *ClusterManager) isStartedUp() bool {
+	manager.mutx.RLock()
+	defer manager.mutx.RUnlock()
+	return manager.startedUp
+}
+
+// wait blocks until every controller has returned
+func (manager *ClusterManager) wait() {
+	manager.wg.Wait()
+}
+
+func isClosed(channel chan struct{}) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// this is what used to be hard coded in NewController
+const defaultResyncPeriod = time.Second * 10
+
+/*
+	The config file replaces the -clusters flag. It can be YAML or JSON (the yaml
+	package turns YAML into JSON before unmarshaling, so the json tags are what count).
+	Something like:
+
+	clusters:
+	  - name: prod
+	    kubeconfig: ./prod.kubeconfig   # relative paths are relative to this file
+	    context: prod-admin             # defaults to the current-context
+	    namespaces: [default, payments] # defaults to every namespace
+	    resyncPeriod: 30s
+	    qps: 20
+	    burst: 40
+	    labels:
+	      env: production
+
+	There can also be a discovery section that turns every context of a kubeconfig
+	into a cluster (see discovery.go) and a hub section that picks up clusters from
+	Secrets while we're running (see hub.go).
+*/
+
+type FileConfig struct {
+	// "namespace" or "name", see multi_globals.go
+	ServiceIdentity string           `json:"serviceIdentity,omitempty"`
+	Clusters        []ClusterConfig  `json:"clusters,omitempty"`
+	Discovery       *DiscoveryConfig `json:"discovery,omitempty"`
+	Hub             *HubConfig       `json:"hub,omitempty"`
+	// mirrors and how images are compared, see images.go
+	Images *ImagesConfig `json:"images,omitempty"`
+	// the cluster(s) every other cluster is compared against, see drift.go
+	Drift *DriftConfig `json:"drift,omitempty"`
+	// dev -> staging -> prod, see promotion.go
+	Promotion *PromotionConfig `json:"promotion,omitempty"`
+	// the release manifest to check the clusters against, see manifest.go
+	Manifest string `json:"manifest,omitempty"`
+	// GitOps checkouts shown as clusters, see gitops.go
+	Git []GitSourceConfig `json:"git,omitempty"`
+	// where to keep the image history across restarts, see historystore.go
+	History *HistoryConfig `json:"history,omitempty"`
+}
+
+type ClusterConfig struct {
+	Name       string `json:"name"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	ClusterSettings
+
+	// set for discovered clusters when more than one kubeconfig file gets merged
+	kubeconfigPaths []string
+	// set for hub clusters, their credentials come out of a Secret instead of a file
+	rest *rest.Config
+}
+
+// ClusterSettings is everything about a cluster that isn't about how to reach it,
+// so discovered clusters can share one copy of it
+type ClusterSettings struct {
+	Namespaces   []string          `json:"namespaces,omitempty"`
+	ResyncPeriod *metav1.Duration  `json:"resyncPeriod,omitempty"`
+	QPS          float32           `json:"qps,omitempty"`
+	Burst        int               `json:"burst,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// which workload kinds to track, all of them if empty
+	Kinds []string `json:"kinds,omitempty"`
+	// extra kinds to watch with the dynamic client (see customresources.go)
+	CustomResources []CustomResourceConfig `json:"customResources,omitempty"`
+}
+
+// loadConfig figures out where the cluster list comes from. Only one source of
+// static clusters is allowed so nobody has to guess which one won. The returned
+// config has the discovered clusters already added to Clusters.
+func loadConfig(configFile, clusterString string, discovery *DiscoveryConfig, hub *HubConfig) (*FileConfig, error) {
+	sources := 0
+	for _, set := range []bool{configFile != "", clusterString != "", discovery != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, errors.New("-config, -clusters and -discover-contexts can't be used together, pick one (the config file has its own discovery section)")
+	}
+
+	var fileConfig *FileConfig
+	switch {
+	case configFile != "":
+		loaded, err := loadConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		fileConfig = loaded
+	case clusterString != "":
+		configs, err := getClustersFromFlag(clusterString)
+		if err != nil {
+			return nil, err
+		}
+		fileConfig = &FileConfig{Clusters: configs}
+	case discovery != nil:
+		if err := validateDiscoveryConfig(discovery); err != nil {
+			return nil, err
+		}
+		configs, err := discoverClusters(discovery, nil)
+		if err != nil {
+			return nil, err
+		}
+		fileConfig = &FileConfig{Clusters: configs, Discovery: discovery}
+	case hub != nil:
+		// a hub can start out without any clusters, they show up as Secrets get created
+		fileConfig = &FileConfig{}
+	default:
+		return nil, errors.New("no clusters specified, use -config=<file>, -discover-contexts or -hub (or the older -clusters='name:path,...')")
+	}
+
+	if hub != nil {
+		if fileConfig.Hub != nil {
+			return nil, errors.New("-hub can't be used with a config file that has a hub section")
+		}
+		fileConfig.Hub = hub
+	}
+
+	if fileConfig.ServiceIdentity != "" {
+		if err := validateServiceIdentity(fileConfig.ServiceIdentity); err != nil {
+			return nil, err
+		}
+	}
+
+	if fileConfig.Images != nil {
+		if err := validateImagesConfig(fileConfig.Images); err != nil {
+			return nil, err
+		}
+	}
+	if fileConfig.Drift != nil {
+		if err := validateDriftConfig(fileConfig.Drift); err != nil {
+			return nil, err
+		}
+	}
+	if fileConfig.Promotion != nil {
+		if err := validatePromotionConfig(fileConfig.Promotion); err != nil {
+			return nil, err
+		}
+	}
+	if fileConfig.History != nil {
+		if err := validateHistoryConfig(fileConfig.History); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateClusterConfigs(fileConfig.Clusters); err != nil {
+		if configFile != "" {
+			return nil, fmt.Errorf("invalid config file %s:\n%w", configFile, err)
+		}
+		return nil, err
+	}
+	if fileConfig.Hub != nil {
+		if err := validateHubConfig(fileConfig.Hub); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateGitSources(fileConfig.Git, fileConfig.Clusters); err != nil {
+		if configFile != "" {
+			return nil, fmt.Errorf("invalid config file %s:\n%w", configFile, err)
+		}
+		return nil, err
+	}
+
+	return fileConfig, nil
+}
+
+func loadConfigFile(path string) (*FileConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var fileConfig FileConfig
+	if err := yaml.UnmarshalStrict(bytes, &fileConfig); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	if len(fileConfig.Clusters) == 0 && fileConfig.Discovery == nil && fileConfig.Hub == nil && len(fileConfig.Git) == 0 {
+		return nil, fmt.Errorf("config file %s doesn't list any clusters or git sources or have a discovery or hub section", path)
+	}
+
+	// kubeconfig paths are relative to the config file, not to wherever the binary was started
+	baseDir := filepath.Dir(path)
+	for i := range fileConfig.Clusters {
+		fileConfig.Clusters[i].Kubeconfig = resolvePath(baseDir, fileConfig.Clusters[i].Kubeconfig)
+	}
+	if fileConfig.Hub != nil {
+		fileConfig.Hub.Kubeconfig = resolvePath(baseDir, fileConfig.Hub.Kubeconfig)
+	}
+	fileConfig.Manifest = resolvePath(baseDir, fileConfig.Manifest)
+	for i := range fileConfig.Git {
+		fileConfig.Git[i].Path = resolvePath(baseDir, fileConfig.Git[i].Path)
+	}
+	if fileConfig.History != nil {
+		fileConfig.History.Path = resolvePath(baseDir, fileConfig.History.Path)
+	}
+
+	if fileConfig.Discovery != nil {
+		for i := range fileConfig.Discovery.Kubeconfigs {
+			fileConfig.Discovery.Kubeconfigs[i] = resolvePath(baseDir, fileConfig.Discovery.Kubeconfigs[i])
+		}
+		if err := validateDiscoveryConfig(fileConfig.Discovery); err != nil {
+			return nil, fmt.Errorf("invalid config file %s:\n%w", path, err)
+		}
+
+		discovered, err := discoverClusters(fileConfig.Discovery, fileConfig.Clusters)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		fileConfig.Clusters = append(fileConfig.Clusters, discovered...)
+	}
+
+	return &fileConfig, nil
+}
+
+// getClustersFromFlag parses the old 'name:path,name:path' format. Only the first colon
+// separates the name from the path so things like C:\Users\me\.kube\config still work.
+func getClustersFromFlag(clusterString string) ([]ClusterConfig, error) {
+	var clusterConfigs []ClusterConfig
+
+	for index, clusterPair := range strings.Split(clusterString, ",") {
+		name, path, found := strings.Cut(strings.TrimSpace(clusterPair), ":")
+		if !found {
+			return nil, fmt.Errorf("-clusters entry #%d (%q) isn't in the name:path format", index, clusterPair)
+		}
+		if path == "" {
+			return nil, fmt.Errorf("-clusters entry #%d (%q) is missing the kubeconfig path", index, clusterPair)
+		}
+
+		clusterConfigs = append(clusterConfigs, ClusterConfig{
+			Name:       name,
+			Kubeconfig: path,
+		})
+	}
+
+	return clusterConfigs, nil
+}
+
+// validateClusterConfigs checks everything it can before we start talking to any cluster
+// and reports every problem at once instead of stopping at the first one.
+func validateClusterConfigs(configs []ClusterConfig) error {
+	var errs []error
+	firstSeen := make(map[string]int)
+
+	for index, config := range configs {
+		where := fmt.Sprintf("clusters[%d]", index)
+		if config.Name != "" {
+			where = fmt.Sprintf("clusters[%d] (%s)", index, config.Name)
+		}
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("%s: %s", where, fmt.Sprintf(format, args...)))
+		}
+
+		switch {
+		case strings.TrimSpace(config.Name) == "":
+			fail("name is required")
+		case strings.TrimSpace(config.Name) != config.Name:
+			fail("name %q has leading or trailing whitespace", config.Name)
+		default:
+			// cluster names are case sensitive
+			if first, exists := firstSeen[config.Name]; exists {
+				fail("duplicate cluster name, already used by clusters[%d]", first)
+			} else {
+				firstSeen[config.Name] = index
+			}
+		}
+
+		if config.Kubeconfig != "" {
+			if _, err := os.Stat(config.Kubeconfig); err != nil {
+				fail("kubeconfig %s can't be read: %s", config.Kubeconfig, err.Error())
+			} else if config.Context != "" {
+				if kubeconfig, err := clientcmd.LoadFromFile(config.Kubeconfig); err != nil {
+					fail("kubeconfig %s isn't a valid kubeconfig file: %s", config.Kubeconfig, err.Error())
+				} else if _, exists := kubeconfig.Contexts[config.Context]; !exists {
+					fail("context %q doesn't exist in kubeconfig %s", config.Context, config.Kubeconfig)
+				}
+			}
+		}
+
+		seenNamespaces := make(map[string]bool)
+		for nsIndex, namespace := range config.Namespaces {
+			if problems := validation.IsDNS1123Label(namespace); len(problems) > 0 {
+				fail("namespaces[%d] %q isn't a valid namespace name: %s", nsIndex, namespace, strings.Join(problems, ", "))
+			}
+			if seenNamespaces[namespace] {
+				fail("namespaces[%d] %q is listed more than once", nsIndex, namespace)
+			}
+			seenNamespaces[namespace] = true
+		}
+
+		if config.ResyncPeriod != nil && config.ResyncPeriod.Duration < 0 {
+			fail("resyncPeriod can't be negative (got %s)", config.ResyncPeriod.Duration)
+		}
+		if config.QPS < 0 {
+			fail("qps can't be negative (got %v)", config.QPS)
+		}
+		if config.Burst < 0 {
+			fail("burst can't be negative (got %d)", config.Burst)
+		}
+
+		for key := range config.Labels {
+			if strings.TrimSpace(key) == "" {
+				fail("labels can't have an empty key")
+			}
+		}
+
+		for _, problem := range validateKinds(config.Kinds) {
+			fail("%s", problem)
+		}
+		for _, problem := range validateCustomResources(config.CustomResources) {
+			fail("%s", problem)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (config *ClusterConfig) resyncPeriod() time.Duration {
+	if config.ResyncPeriod == nil {
+		return defaultResyncPeriod
+	}
+	return config.ResyncPeriod.Duration
+}
+
+// restConfig builds the client config for the cluster. An empty kubeconfig falls back to the
+// usual client-go rules ($KUBECONFIG, then ~/.kube/config, then in-cluster), and an empty context
+// means the file's current-context, which is exactly what BuildConfigFromFlags used to do.
+func (config *ClusterConfig) restConfig() (*rest.Config, error) {
+	var restConfig *rest.Config
+	if config.rest != nil {
+		restConfig = rest.CopyConfig(config.rest)
+	} else {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if config.Kubeconfig != "" {
+			rules.ExplicitPath = config.Kubeconfig
+		} else if len(config.kubeconfigPaths) > 0 {
+			rules.Precedence = config.kubeconfigPaths
+		}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: config.Context}
+
+		loaded, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		restConfig = loaded
+	}
+
+	if config.QPS > 0 {
+		restConfig.QPS = config.QPS
+	}
+	if config.Burst > 0 {
+		restConfig.Burst = config.Burst
+	}
+
+	return restConfig, nil
+}
+
+func resolvePath(baseDir, path string) string {
+	if path == "" {
+		return path
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/jsonpath"
+	"k8s.io/klog/v2"
+)
+
+/*
+	Argo Rollouts, Knative Services and the in-house CRDs people build run images too, but we
+	can't have a typed informer for every one of them. A custom resource is described in the
+	cluster config with its group/version/resource (like in the dynamic client example) and a
+	JSONPath to its containers, and it gets a dynamic informer next to the typed ones:
+
+	clusters:
+	  - name: prod
+	    customResources:
+	      - kind: Rollout
+	        group: argoproj.io
+	        version: v1alpha1
+	        resource: rollouts
+	        # optional, this is the default and works for anything shaped like a Deployment
+	        containers: "{.spec.template.spec.containers[*]}"
+	      - kind: KnativeService
+	        group: serving.knative.dev
+	        version: v1
+	        resource: services
+
+	The JSONPath can point at the list of containers or at each container. Only namespaced
+	resources are supported, a cluster scoped one is skipped with an error. Custom resources
+	are tracked whatever the cluster's kinds say, and one that isn't installed in a cluster is
+	skipped with a log instead of holding it up.
+*/
+
+const defaultContainersPath = "{.spec.template.spec.containers[*]}"
+
+type CustomResourceConfig struct {
+	// what the resource shows up as, it can't be one of the built in kinds
+	Kind       string `json:"kind"`
+	Group      string `json:"group,omitempty"`
+	Version    string `json:"version"`
+	Resource   string `json:"resource"`
+	Containers string `json:"containers,omitempty"`
+}
+
+func (resource CustomResourceConfig) gvr() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: resource.Group, Version: resource.Version, Resource: resource.Resource}
+}
+
+func (resource CustomResourceConfig) containersPath() string {
+	if resource.Containers == "" {
+		return defaultContainersPath
+	}
+	return resource.Containers
+}
+
+func (resource CustomResourceConfig) parseContainersPath() (*jsonpath.JSONPath, error) {
+	path := jsonpath.New(resource.Kind)
+	if err := path.Parse(resource.containersPath()); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+func validateCustomResources(resources []CustomResourceConfig) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for index, resource := range resources {
+		fail := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("customResources[%d] (%s): %s", index, resource.Kind, fmt.Sprintf(format, args...)))
+		}
+		if resource.Kind == "" {
+			fail("kind is required")
+		} else if _, builtIn := findWorkloadKind(resource.Kind); builtIn {
+			fail("kind %q is already a built in kind, give it another name", resource.Kind)
+		} else if seen[resource.Kind] {
+			fail("kind %q is listed more than once", resource.Kind)
+		}
+		seen[resource.Kind] = true
+		if resource.Version == "" {
+			fail("version is required")
+		}
+		if resource.Resource == "" {
+			fail("resource is required (the plural, like rollouts)")
+		}
+		if _, err := resource.parseContainersPath(); err != nil {
+			fail("containers %q isn't a valid JSONPath: %s", resource.containersPath(), err.Error())
+		}
+	}
+	return problems
+}
+
+// workloadKind turns the config into a kind the controller can watch. The path has already
+// been validated, so it's parsed once here instead of on every sync.
+func (resource CustomResourceConfig) workloadKind() workloadKind {
+	path, err := resource.parseContainersPath()
+	return workloadKind{
+		name: resource.Kind,
+		gvr:  resource.gvr(),
+		podSpec: func(obj interface{}) (*corev1.PodSpec, error) {
+			if err != nil {
+				return nil, err
+			}
+			object, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, fmt.Errorf("expected an unstructured %s but got a %T", resource.Kind, obj)
+			}
+			containers, err := containersAt(path, object.Object)
+			if err != nil {
+				return nil, fmt.Errorf("containers %s: %w", resource.containersPath(), err)
+			}
+			return &corev1.PodSpec{Containers: containers}, nil
+		},
+	}
+}
+
+// containersAt runs the JSONPath and converts whatever it finds into containers. Each result can
+// be a container or a list of them, depending on whether the path ends with [*].
+func containersAt(path *jsonpath.JSONPath, object map[string]interface{}) ([]corev1.Container, error) {
+	results, err := path.FindResults(object)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []interface{}
+	for _, result := range results {
+		for _, value := range result {
+			if value.Kind() == reflect.Interface {
+				value = value.Elem()
+			}
+			if value.Kind() == reflect.Slice {
+				for i := 0; i < value.Len(); i++ {
+					found = append(found, value.Index(i).Interface())
+				}
+			} else {
+				found = append(found, value.Interface())
+			}
+		}
+	}
+
+	containers := make([]corev1.Container, 0, len(found))
+	for _, item := range found {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("found %v, which isn't a container", item)
+		}
+		var container corev1.Container
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(fields, &container); err != nil {
+			return nil, err
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// customResourceServed checks with discovery that the cluster has the resource and returns it,
+// or nil if it doesn't. An informer for one that isn't installed would never sync and the
+// cluster would never start.
+func (c *Controller) customResourceServed(gvr schema.GroupVersionResource) (*metav1.APIResource, error) {
+	resources, err := c.client.Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == gvr.Resource {
+			return &resource, nil
+		}
+	}
+	return nil, nil
+}
+
+// watchCustomResources adds the dynamic informers for the custom resources this cluster has.
+// It has to run before the dynamic factories are started.
+func (c *Controller) watchCustomResources(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	for _, resource := range c.config.CustomResources {
+		kind := c.kinds[resource.Kind]
+		var served *metav1.APIResource
+		// keep asking while the cluster can't be reached, like the caches would keep waiting to sync
+		err := wait.PollUntilContextCancel(ctx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+			var err error
+			served, err = c.customResourceServed(kind.gvr)
+			if err != nil {
+				logger.Error(err, "Couldn't check for a custom resource, retrying", "controller", c.clusterName, "resource", kind.gvr)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("checking custom resources for controller %s: %w", c.clusterName, err)
+		}
+		if served == nil {
+			logger.Info("Custom resource isn't installed, skipping it", "controller", c.clusterName, "kind", kind.name, "resource", kind.gvr)
+			continue
+		}
+		// workloads are keyed by namespace, and an informer limited to the cluster's namespaces
+		// would never sync a cluster scoped resource
+		if !served.Namespaced {
+			logger.Error(nil, "Custom resource is cluster scoped, only namespaced ones are supported, skipping it", "controller", c.clusterName, "kind", kind.name, "resource", kind.gvr)
+			continue
+		}
+		kind.ownerKind = served.Kind
+		c.kinds[kind.name] = kind
+		c.ownerKinds[kind.ownerKind] = kind.name
+
+		for _, factory := range c.dInformerFactories {
+			informer := factory.ForResource(kind.gvr).Informer()
+			c.informers[kind.name] = append(c.informers[kind.name], informer)
+			c.addWorkloadHandlers(ctx, kind.name, informer)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+/*
+	Discovery turns every context in a kubeconfig into its own cluster, named after the context.
+	Most people already have all of their clusters as contexts in ~/.kube/config so this saves
+	them from listing each one by hand. In the config file it looks like:
+
+	discovery:
+	  kubeconfigs: [~/.kube/config, ./extra.kubeconfig] # merged like $KUBECONFIG, defaults to $KUBECONFIG or ~/.kube/config
+	  include: ["prod-*", "staging-*"]                  # defaults to every context
+	  exclude: ["*-old"]
+	  namespaces: [default]                             # any of the per-cluster settings apply to every discovered cluster
+	  labels:
+	    source: kubeconfig
+
+	Patterns only know about '*' (anything, including '/') and '?' (a single character)
+	because context names like the ones OpenShift generates have slashes and colons in them.
+	Clusters listed explicitly under clusters: win over a discovered context with the same name.
+*/
+
+type DiscoveryConfig struct {
+	Kubeconfigs []string `json:"kubeconfigs,omitempty"`
+	Include     []string `json:"include,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+	ClusterSettings
+}
+
+func validateDiscoveryConfig(discovery *DiscoveryConfig) error {
+	var errs []error
+
+	for index, path := range discovery.Kubeconfigs {
+		if path == "" {
+			errs = append(errs, fmt.Errorf("discovery.kubeconfigs[%d]: path can't be empty", index))
+		} else if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("discovery.kubeconfigs[%d]: %s can't be read: %s", index, path, err.Error()))
+		}
+	}
+	for index, pattern := range discovery.Include {
+		if strings.TrimSpace(pattern) == "" {
+			errs = append(errs, fmt.Errorf("discovery.include[%d]: pattern can't be empty", index))
+		}
+	}
+	for index, pattern := range discovery.Exclude {
+		if strings.TrimSpace(pattern) == "" {
+			errs = append(errs, fmt.Errorf("discovery.exclude[%d]: pattern can't be empty", index))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// discoverClusters makes a ClusterConfig for each matching context. explicit is the list of
+// clusters that were already spelled out, anything discovered with one of their names is skipped.
+func discoverClusters(discovery *DiscoveryConfig, explicit []ClusterConfig) ([]ClusterConfig, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if len(discovery.Kubeconfigs) > 0 {
+		rules.Precedence = discovery.Kubeconfigs
+	}
+
+	merged, err := rules.Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig for discovery: %w", err)
+	}
+
+	taken := make(map[string]bool)
+	for _, config := range explicit {
+		taken[config.Name] = true
+	}
+
+	var contextNames []string
+	for name := range merged.Contexts {
+		contextNames = append(contextNames, name)
+	}
+	// map order is random and nobody wants the controllers to start in a different order every time
+	sort.Strings(contextNames)
+
+	var discovered []ClusterConfig
+	for _, name := range contextNames {
+		if !discovery.matches(name) {
+			continue
+		}
+		if taken[name] {
+			klog.InfoS("Context is also listed under clusters, using that entry instead", "context", name)
+			continue
+		}
+
+		context := merged.Contexts[name]
+		if _, exists := merged.Clusters[context.Cluster]; !exists {
+			klog.InfoS("Skipping context, it points at a cluster that isn't in the kubeconfig", "context", name, "cluster", context.Cluster)
+			continue
+		}
+		if _, exists := merged.AuthInfos[context.AuthInfo]; !exists && context.AuthInfo != "" {
+			klog.InfoS("Skipping context, it points at a user that isn't in the kubeconfig", "context", name, "user", context.AuthInfo)
+			continue
+		}
+
+		discovered = append(discovered, ClusterConfig{
+			Name:            name,
+			Context:         name,
+			ClusterSettings: discovery.ClusterSettings,
+			kubeconfigPaths: rules.Precedence,
+		})
+	}
+
+	if len(discovered) == 0 && len(explicit) == 0 {
+		return nil, fmt.Errorf("discovery didn't match any contexts (include: %v, exclude: %v)", discovery.Include, discovery.Exclude)
+	}
+
+	return discovered, nil
+}
+
+func (discovery *DiscoveryConfig) matches(contextName string) bool {
+	included := len(discovery.Include) == 0
+	for _, pattern := range discovery.Include {
+		if matchGlob(pattern, contextName) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for _, pattern := range discovery.Exclude {
+		if matchGlob(pattern, contextName) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchGlob(pattern, name string) bool {
+	expression := regexp.QuoteMeta(pattern)
+	expression = strings.ReplaceAll(expression, `\*`, ".*")
+	expression = strings.ReplaceAll(expression, `\?`, ".")
+	return regexp.MustCompile("^" + expression + "$").MatchString(name)
+}
+
+// splitList is for the comma separated flags, empty entries are dropped
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
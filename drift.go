@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+/*
+	Drift is every cluster compared against a reference instead of everyone eyeballing colours.
+	The reference is one cluster, or a group of them picked by their labels:
+
+	drift:
+	  reference: prod
+	  # or
+	  referenceSelector: env=production
+
+	GET /drift uses that (?reference=... or ?referenceSelector=... override it). For every service
+	each other cluster is one of:
+
+		match    - runs the same version as the reference
+		behind   - runs an older version (by the service's ordering, see ordering.go)
+		ahead    - runs a newer version
+		differs  - runs something else that can't be ordered, or a different set of containers
+		missing  - doesn't run the service at all
+		extra    - runs a service the reference doesn't have
+
+	When the reference is a group, the newest version in the group is what the others are compared to.
+*/
+
+const (
+	driftMatch   = "match"
+	driftBehind  = "behind"
+	driftAhead   = "ahead"
+	driftDiffers = "differs"
+	driftMissing = "missing"
+	driftExtra   = "extra"
+
+	driftInSync = "in sync"
+)
+
+type DriftConfig struct {
+	Reference         string `json:"reference,omitempty"`
+	ReferenceSelector string `json:"referenceSelector,omitempty"`
+}
+
+var driftSettings DriftConfig
+
+func validateDriftConfig(drift *DriftConfig) error {
+	if drift.Reference != "" && drift.ReferenceSelector != "" {
+		return errors.New("drift: use reference or referenceSelector, not both")
+	}
+	if drift.ReferenceSelector != "" {
+		if _, err := labels.Parse(drift.ReferenceSelector); err != nil {
+			return fmt.Errorf("drift.referenceSelector: %w", err)
+		}
+	}
+	return nil
+}
+
+type DriftReport struct {
+	Reference []string       `json:"reference"`
+	Services  []ServiceDrift `json:"services"`
+}
+
+type ServiceDrift struct {
+	Service  string         `json:"service"`
+	Ordering string         `json:"ordering"`
+	Clusters []ClusterDrift `json:"clusters"`
+}
+
+type ClusterDrift struct {
+	Cluster    string           `json:"cluster"`
+	Status     string           `json:"status"`
+	Containers []ContainerDrift `json:"containers,omitempty"`
+}
+
+type ContainerDrift struct {
+	Name           string `json:"name"`
+	Image          string `json:"image,omitempty"`
+	ReferenceImage string `json:"referenceImage,omitempty"`
+	Status         string `json:"status"`
+}
+
+func getDrift(writer http.ResponseWriter, req *http.Request) {
+	drift := driftSettings
+	// either one replaces the config's reference, both at once is a 400 from validateDriftConfig
+	reference, selector := req.URL.Query().Get("reference"), req.URL.Query().Get("referenceSelector")
+	if reference != "" || selector != "" {
+		drift = DriftConfig{Reference: reference, ReferenceSelector: selector}
+	}
+	if err := validateDriftConfig(&drift); err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	if drift.Reference == "" && drift.ReferenceSelector == "" {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: "no reference cluster, set drift in the config file or use ?reference=<cluster>"})
+		return
+	}
+
+	report, err := driftReport(req.Context(), drift, servingSnapshots(Controllers.snapshot()))
+	if err != nil {
+		writeJSON(writer, http.StatusNotFound, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(writer, http.StatusOK, report)
+}
+
+// referenceClusters is the names of the snapshots that make up the reference
+func referenceClusters(drift DriftConfig, snapshots []ClusterSnapshot) map[string]bool {
+	reference := make(map[string]bool)
+	selector, _ := labels.Parse(drift.ReferenceSelector)
+	for _, snapshot := range snapshots {
+		if drift.Reference != "" && snapshot.ClusterName == drift.Reference {
+			reference[snapshot.ClusterName] = true
+		}
+		if drift.ReferenceSelector != "" && selector.Matches(labels.Set(snapshot.Labels)) {
+			reference[snapshot.ClusterName] = true
+		}
+	}
+	return reference
+}
+
+func driftReport(ctx context.Context, drift DriftConfig, snapshots []ClusterSnapshot) (DriftReport, error) {
+	reference := referenceClusters(drift, snapshots)
+	if len(reference) == 0 {
+		return DriftReport{}, fmt.Errorf("no running cluster matches the reference (%s%s)", drift.Reference, drift.ReferenceSelector)
+	}
+
+	report := DriftReport{Reference: []string{}, Services: []ServiceDrift{}}
+	for _, snapshot := range snapshots {
+		if reference[snapshot.ClusterName] {
+			report.Reference = append(report.Reference, snapshot.ClusterName)
+		}
+	}
+	services := serviceKeys(snapshots)
+	prepareOrders(ctx, snapshots, services)
+	for _, service := range services {
+		report.Services = append(report.Services, serviceDrift(service, reference, snapshots))
+	}
+	return report, nil
+}
+
+func serviceDrift(service string, reference map[string]bool, snapshots []ClusterSnapshot) ServiceDrift {
+	order := versionOrderFor(service)
+	result := ServiceDrift{Service: service, Ordering: orderingFor(service), Clusters: []ClusterDrift{}}
+
+	// the newest of each container across the reference clusters
+	referenceContainers := make(map[string]ContainerInfo)
+	for _, snapshot := range snapshots {
+		if !reference[snapshot.ClusterName] {
+			continue
+		}
+		for _, container := range serviceContainers(snapshot, service) {
+			current, exists := referenceContainers[container.Name]
+			if !exists {
+				referenceContainers[container.Name] = container
+			} else if newer, ok := order.compare(container, current); ok && newer > 0 {
+				referenceContainers[container.Name] = container
+			}
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		if reference[snapshot.ClusterName] {
+			continue
+		}
+		containers := serviceContainers(snapshot, service)
+		switch {
+		case len(containers) == 0 && len(referenceContainers) == 0:
+			continue
+		case len(containers) == 0:
+			result.Clusters = append(result.Clusters, ClusterDrift{Cluster: snapshot.ClusterName, Status: driftMissing})
+		case len(referenceContainers) == 0:
+			result.Clusters = append(result.Clusters, ClusterDrift{Cluster: snapshot.ClusterName, Status: driftExtra})
+		default:
+			result.Clusters = append(result.Clusters, clusterDrift(order, snapshot.ClusterName, containers, referenceContainers))
+		}
+	}
+	return result
+}
+
+func clusterDrift(order versionOrder, cluster string, containers []ContainerInfo, referenceContainers map[string]ContainerInfo) ClusterDrift {
+	result := ClusterDrift{Cluster: cluster}
+	seen := make(map[string]bool)
+	for _, container := range containers {
+		seen[container.Name] = true
+		drift := ContainerDrift{Name: container.Name, Image: container.displayImage()}
+		referenceContainer, exists := referenceContainers[container.Name]
+		if !exists {
+			drift.Status = driftDiffers
+			result.Containers = append(result.Containers, drift)
+			continue
+		}
+		drift.ReferenceImage = referenceContainer.displayImage()
+		drift.Status = containerDrift(order, container, referenceContainer)
+		result.Containers = append(result.Containers, drift)
+	}
+	for name, referenceContainer := range referenceContainers {
+		if !seen[name] {
+			result.Containers = append(result.Containers, ContainerDrift{Name: name, ReferenceImage: referenceContainer.displayImage(), Status: driftDiffers})
+		}
+	}
+	sort.Slice(result.Containers, func(i, j int) bool { return result.Containers[i].Name < result.Containers[j].Name })
+
+	statuses := make(map[string]bool)
+	for _, container := range result.Containers {
+		statuses[container.Status] = true
+	}
+	delete(statuses, driftMatch)
+	switch {
+	case len(statuses) == 0:
+		result.Status = driftMatch
+	case len(statuses) == 1 && (statuses[driftBehind] || statuses[driftAhead]):
+		if statuses[driftBehind] {
+			result.Status = driftBehind
+		} else {
+			result.Status = driftAhead
+		}
+	default:
+		result.Status = driftDiffers
+	}
+	return result
+}
+
+func containerDrift(order versionOrder, container, referenceContainer ContainerInfo) string {
+	if container.versionKey() == referenceContainer.versionKey() {
+		return driftMatch
+	}
+	result, ok := order.compare(container, referenceContainer)
+	switch {
+	case !ok || result == 0:
+		// something else with the same version number (a tag that got pushed over) counts as different too
+		return driftDiffers
+	case result < 0:
+		return driftBehind
+	default:
+		return driftAhead
+	}
+}
+
+// serviceContainers is the containers of every workload of the service in the cluster
+func serviceContainers(snapshot ClusterSnapshot, service string) []ContainerInfo {
+	var containers []ContainerInfo
+	for _, key := range sortedWorkloadKeys(snapshot.Workloads) {
+		if serviceKey(key) == service {
+			containers = append(containers, snapshot.Workloads[key].Containers...)
+		}
+	}
+	return containers
+}
+
+// driftSummary is the drift column of the HTML report for one service
+func driftSummary(drift ServiceDrift) string {
+	var lines []string
+	for _, cluster := range drift.Clusters {
+		if cluster.Status != driftMatch {
+			lines = append(lines, fmt.Sprintf("%s: %s", cluster.Cluster, cluster.Status))
+		}
+	}
+	if len(lines) == 0 {
+		return driftInSync
+	}
+	return strings.Join(lines, "<br>")
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"strings"
 
 	// v1 "k8s.io/api/apps/v1"
 	// apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/Gr1nx-bitibt/kubetroller/imageref"
 )
 
 func list() {
@@ -31,8 +32,12 @@ func list() {
 	items := list.Items
 	for _, item := range items {
 		containers := item.Spec.Template.Spec.Containers
-		tag := containers[0].Image
-		parts := strings.Split(tag, ":")
-		fmt.Println(parts[len(parts)-1])
+		// splitting on ":" breaks on registries with a port and on digests
+		ref, err := imageref.Parse(containers[0].Image)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		fmt.Println(ref.Version())
 	}
 }
@@ -1,25 +1,26 @@
 export default yes = [
     {
         "clusterName":"chicken",
-        "serviceImagePair":{
-            "coredns":"registry.k8s.io/coredns/coredns:v1.11.1 | ",
-            "storage-provisioner-deployment":"docker/desktop-storage-provisioner:v2.0 | ",
-            "vpnkit-controller-deployment":"docker/desktop-vpnkit-controller:dc331cb22850be0cdd97c84a9cfecaf44a1afb6e | "},
+        "services":[
+            {"service":"kube-system/coredns","kind":"Deployment","namespace":"kube-system","name":"coredns","containers":[{"name":"coredns","image":"registry.k8s.io/coredns/coredns:v1.11.1"}]},
+            {"service":"kube-system/storage-provisioner-deployment","kind":"Deployment","namespace":"kube-system","name":"storage-provisioner-deployment","containers":[{"name":"storage-provisioner-deployment","image":"docker/desktop-storage-provisioner:v2.0"}]},
+            {"service":"kube-system/vpnkit-controller-deployment","kind":"Deployment","namespace":"kube-system","name":"vpnkit-controller-deployment","containers":[{"name":"vpnkit-controller-deployment","image":"docker/desktop-vpnkit-controller:dc331cb22850be0cdd97c84a9cfecaf44a1afb6e"}]}],
         "date":"2024-September-09"
     },
     {
         "clusterName":"batman",
-        "serviceImagePair":{
-            "coredns":"registry.k8s.io/coredns/coredns:v1.11.1 | ",
-            "storage-provisioner-deployment":"docker/desktop-storage-provisioner:v2.0 | ",
-            "vpnkit-controller-deployment":"docker/desktop-vpnkit-controller:dc331cb22850be0cdd97c84a9cfecaf44a1afb6e | "},
+        "services":[
+            {"service":"kube-system/coredns","kind":"Deployment","namespace":"kube-system","name":"coredns","containers":[{"name":"coredns","image":"registry.k8s.io/coredns/coredns:v1.11.1"}]},
+            {"service":"kube-system/storage-provisioner-deployment","kind":"Deployment","namespace":"kube-system","name":"storage-provisioner-deployment","containers":[{"name":"storage-provisioner-deployment","image":"docker/desktop-storage-provisioner:v2.0"}]},
+            {"service":"kube-system/vpnkit-controller-deployment","kind":"Deployment","namespace":"kube-system","name":"vpnkit-controller-deployment","containers":[{"name":"vpnkit-controller-deployment","image":"docker/desktop-vpnkit-controller:dc331cb22850be0cdd97c84a9cfecaf44a1afb6e"}]}],
         "date":"2024-September-09"
     },
     {
         "clusterName":"meliodas",
-        "serviceImagePair":{
-            "coredns":"registry.k8s.io/coredns/coredns:v1.11.1 | ",
-            "storage-provisioner-deployment":"docker/desktop-storage-provisioner:v2.0 | ",
-            "vpnkit-controller-deployment":"docker/desktop-vpnkit-controller:dc331cb22850be0cdd97c84a9cfecaf44a1afb6e | "},
-        "date":"2024-September-09"}
+        "services":[
+            {"service":"kube-system/coredns","kind":"Deployment","namespace":"kube-system","name":"coredns","containers":[{"name":"coredns","image":"registry.k8s.io/coredns/coredns:v1.11.1"}]},
+            {"service":"kube-system/storage-provisioner-deployment","kind":"Deployment","namespace":"kube-system","name":"storage-provisioner-deployment","containers":[{"name":"storage-provisioner-deployment","image":"docker/desktop-storage-provisioner:v2.0"}]},
+            {"service":"kube-system/vpnkit-controller-deployment","kind":"Deployment","namespace":"kube-system","name":"vpnkit-controller-deployment","containers":[{"name":"vpnkit-controller-deployment","image":"docker/desktop-vpnkit-controller:dc331cb22850be0cdd97c84a9cfecaf44a1afb6e"}]}],
+        "date":"2024-September-09"
+    }
 ]
\ No newline at end of file
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog/v2"
+)
+
+/*
+	What's in the GitOps repo is what should be running, so it gets its own column next to the
+	real clusters: a git source reads the workload manifests out of a directory and shows up
+	as a (virtual) cluster in everything, the table, /versions, /drift and so on.
+
+	git:
+	  - name: git-prod
+	    # a checkout or a bare repo. With a ref the files are read from that commit with
+	    # git archive (so the checkout's working tree doesn't matter), without one they're
+	    # read straight from the directory
+	    path: ./gitops
+	    ref: origin/main
+	    # only look under this directory of the repo
+	    dir: clusters/prod
+	    # for manifests that don't say, like kubectl apply would
+	    namespace: default
+	    labels:
+	      env: production
+	    # how often to read it again, 1m if it's left out
+	    interval: 1m
+
+	Every .yaml, .yml and .json file is read, with any number of documents in it, so plain
+	manifests and the output of kustomize build (or helm template) committed to the repo both
+	work. Lists are looked into, anything that isn't one of the built in workload kinds (a
+	kustomization.yaml, Services, ConfigMaps) is skipped, and so are files that don't parse,
+	like unrendered templates. Git sources that get added to, changed in or removed from the
+	config file are picked up while we're running, like clusters are (see reload.go).
+*/
+
+const (
+	sourceGit          = "git"
+	defaultGitInterval = time.Minute
+)
+
+var manifestExtensions = []string{".yaml", ".yml", ".json"}
+
+type GitSourceConfig struct {
+	Name      string            `json:"name"`
+	Path      string            `json:"path"`
+	Ref       string            `json:"ref,omitempty"`
+	Dir       string            `json:"dir,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Kinds     []string          `json:"kinds,omitempty"`
+	Interval  *metav1.Duration  `json:"interval,omitempty"`
+}
+
+func validateGitSources(sources []GitSourceConfig, clusters []ClusterConfig) error {
+	var errs []error
+	names := make(map[string]bool)
+	for _, cluster := range clusters {
+		names[cluster.Name] = true
+	}
+	for index, source := range sources {
+		where := fmt.Sprintf("git[%d]", index)
+		switch {
+		case strings.TrimSpace(source.Name) == "":
+			errs = append(errs, fmt.Errorf("%s: name is required", where))
+		case names[source.Name]:
+			errs = append(errs, fmt.Errorf("%s: %q is already the name of a cluster or another git source", where, source.Name))
+		}
+		names[source.Name] = true
+		if source.Path == "" {
+			errs = append(errs, fmt.Errorf("%s: path is required", where))
+		} else if _, err := os.Stat(source.Path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", where, err))
+		}
+		if invalid := validateKinds(source.Kinds); len(invalid) > 0 {
+			errs = append(errs, fmt.Errorf("%s: %s", where, strings.Join(invalid, ", ")))
+		}
+		if source.Interval != nil && source.Interval.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s: interval has to be more than 0", where))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (config GitSourceConfig) interval() time.Duration {
+	if config.Interval == nil {
+		return defaultGitInterval
+	}
+	return config.Interval.Duration
+}
+
+func (config GitSourceConfig) kinds() []string {
+	if len(config.Kinds) == 0 {
+		return workloadKindNames()
+	}
+	return config.Kinds
+}
+
+// gitSource is a Source (see source.go) that reads everything every interval and sends it as
+// one Replace
+type gitSource struct {
+	config GitSourceConfig
+}
+
+func newGitSource(config GitSourceConfig) *gitSource {
+	return &gitSource{config: config}
+}
+
+func (source *gitSource) Name() string {
+	return source.config.Name
+}
+
+func (source *gitSource) Labels() map[string]string {
+	return source.config.Labels
+}
+
+// Run reads the manifests every interval until ctx is done. When reading them fails what was
+// read last time is kept.
+func (source *gitSource) Run(ctx context.Context, events chan<- InventoryEvent) error {
+	logger := klog.FromContext(ctx).WithValues("source", source.config.Name)
+	synced := false
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		workloads, err := source.read(ctx)
+		if err != nil {
+			logger.Error(err, "Couldn't read the git source, keeping what it had")
+			sendEvent(ctx, events, InventoryEvent{Type: InventoryHealth, Err: err})
+			return
+		}
+		sendEvent(ctx, events, InventoryEvent{Type: InventoryReplace, Workloads: workloads})
+		sendEvent(ctx, events, InventoryEvent{Type: InventoryHealth})
+		if !synced {
+			sendEvent(ctx, events, InventoryEvent{Type: InventorySynced})
+			synced = true
+		}
+		logger.V(4).Info("Read the git source", "workloads", len(workloads))
+	}, source.config.interval())
+	return nil
+}
+
+// read is every workload in the source's manifests
+func (source *gitSource) read(ctx context.Context) (map[WorkloadKey]DeployConfigs, error) {
+	files, err := source.files(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := klog.FromContext(ctx)
+	workloads := make(map[WorkloadKey]DeployConfigs)
+	for name, contents := range files {
+		objects, err := decodeManifests(contents)
+		if err != nil {
+			logger.V(2).Info("Skipping a file that isn't a manifest", "source", source.config.Name, "file", name, "err", err.Error())
+		}
+		for _, object := range objects {
+			key, config, ok := source.workload(object)
+			if !ok {
+				continue
+			}
+			if _, exists := workloads[key]; exists {
+				logger.Info("Workload is in the manifests more than once, the last one wins", "source", source.config.Name, "key", key, "file", name)
+			}
+			workloads[key] = config
+		}
+	}
+	return workloads, nil
+}
+
+// files is the contents of every manifest file, by path
+func (source *gitSource) files(ctx context.Context) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if source.config.Ref == "" {
+		root := filepath.Join(source.config.Path, source.config.Dir)
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if entry.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isManifestFile(path) {
+				return nil
+			}
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[path] = contents
+			return nil
+		})
+		return files, err
+	}
+
+	args := []string{"-C", source.config.Path, "archive", "--format=tar", source.config.Ref}
+	if source.config.Dir != "" {
+		args = append(args, "--", source.config.Dir)
+	}
+	var stdout, stderr bytes.Buffer
+	command := exec.CommandContext(ctx, "git", args...)
+	command.Stdout, command.Stderr = &stdout, &stderr
+	if err := command.Run(); err != nil {
+		return nil, fmt.Errorf("git archive %s in %s: %w: %s", source.config.Ref, source.config.Path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	archive := tar.NewReader(&stdout)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !isManifestFile(header.Name) {
+			continue
+		}
+		contents, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = contents
+	}
+}
+
+func isManifestFile(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	for _, manifestExtension := range manifestExtensions {
+		if extension == manifestExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeManifests is every object in a file of YAML (or JSON) documents, with Lists unpacked.
+// What it got before a document failed to parse is still returned along with the error.
+func decodeManifests(contents []byte) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	decoder := k8syaml.NewYAMLOrJSONDecoder(bytes.NewReader(contents), 4096)
+	for {
+		var document map[string]interface{}
+		if err := decoder.Decode(&document); err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+			return objects, err
+		}
+		if len(document) == 0 {
+			continue
+		}
+		object := &unstructured.Unstructured{Object: document}
+		if object.IsList() {
+			list, err := object.ToList()
+			if err != nil {
+				return objects, err
+			}
+			for index := range list.Items {
+				objects = append(objects, &list.Items[index])
+			}
+			continue
+		}
+		objects = append(objects, object)
+	}
+}
+
+// workload turns a manifest into a workload if it's one of the kinds the source tracks
+func (source *gitSource) workload(object *unstructured.Unstructured) (WorkloadKey, DeployConfigs, bool) {
+	kindName := object.GetKind()
+	tracked := false
+	for _, name := range source.config.kinds() {
+		tracked = tracked || name == kindName
+	}
+	kind, known := findWorkloadKind(kindName)
+	if !tracked || !known || object.GetName() == "" {
+		return WorkloadKey{}, DeployConfigs{}, false
+	}
+
+	// the podSpec functions want the typed object the informers would have handed them
+	typed, err := scheme.Scheme.New(object.GroupVersionKind())
+	if err != nil {
+		return WorkloadKey{}, DeployConfigs{}, false
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, typed); err != nil {
+		return WorkloadKey{}, DeployConfigs{}, false
+	}
+	podSpec, err := kind.podSpec(typed)
+	if err != nil {
+		return WorkloadKey{}, DeployConfigs{}, false
+	}
+
+	namespace := object.GetNamespace()
+	if namespace == "" {
+		namespace = source.config.Namespace
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	key := WorkloadKey{Kind: kindName, Namespace: namespace, Name: object.GetName()}
+	return key, DeployConfigs{
+		Cluster:    source.config.Name,
+		Kind:       kindName,
+		Namespace:  namespace,
+		Name:       object.GetName(),
+		Containers: containerInfos(podSpec),
+	}, true
+}
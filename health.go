@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	One cluster's API server going away shouldn't take the others down with it, so a cluster
+	that can't be reached (or whose source fails) is reported instead of ending the process:
+
+	GET /healthz   200 while the process is up, for liveness probes
+	GET /readyz    200 once startup is done and at least one cluster is serving data (or there
+	               are no clusters), 503 otherwise. Either way the body says how each cluster
+	               is doing, the same status /admin/clusters and /api/v1/clusters show.
+
+	Sources report how they're doing with InventoryHealth events (see source.go): a controller
+	checks its API server every healthInterval (the version, and a list of one pod to check the
+	credentials still work) and reports every failed list or watch of its informers as it
+	happens, a git source reports every read. A cluster's state is one of
+
+	syncing      it hasn't sent everything it has yet
+	ready        it has, and the last check worked
+	degraded     it has, but the last check failed, so what it has might be out of date
+	unavailable  it hasn't synced and the last check failed, or its source couldn't be built
+	             (like a kubeconfig that can't be read) or stopped with an error. It stays in
+	             / and the report with its state and lastError but none of its workloads, and
+	             it's left out of /versions, /drift, /promotion and /compliance until it's
+	             back. Sources that fail are retried in the background, waiting 1s and then
+	             twice as long each time up to 5m (nextRetry in the status says when).
+*/
+
+const (
+	clusterSyncing     = "syncing"
+	clusterReady       = "ready"
+	clusterDegraded    = "degraded"
+	clusterUnavailable = "unavailable"
+
+	healthInterval = 30 * time.Second
+)
+
+// clusterHealth is what a cluster's source last reported
+type clusterHealth struct {
+	connected     bool
+	lastList      time.Time
+	lastError     string
+	lastErrorTime time.Time
+	serverVersion string
+	// the source couldn't be built or its Run returned an error, it's waiting for nextRetry
+	failed    bool
+	nextRetry time.Time
+	mutx      sync.Mutex
+}
+
+type HealthReport struct {
+	Status   string          `json:"status"`
+	Clusters []ClusterStatus `json:"clusters"`
+}
+
+func (health *clusterHealth) report(err error, version string, at time.Time) {
+	health.mutx.Lock()
+	defer health.mutx.Unlock()
+	if err != nil {
+		health.connected = false
+		health.lastError, health.lastErrorTime = err.Error(), at
+		return
+	}
+	health.connected, health.lastList = true, at
+	if version != "" {
+		health.serverVersion = version
+	}
+}
+
+// stopped records that the source failed and when it's retried, and says whether it had
+// already failed before
+func (health *clusterHealth) stopped(err error, at, retry time.Time) bool {
+	health.mutx.Lock()
+	defer health.mutx.Unlock()
+	wasFailing := health.failed
+	health.failed, health.connected = true, false
+	health.lastError, health.lastErrorTime, health.nextRetry = err.Error(), at, retry
+	return wasFailing
+}
+
+// retrying is when a new attempt has been built, it's unavailable until it syncs or connects
+func (health *clusterHealth) retrying() {
+	health.mutx.Lock()
+	defer health.mutx.Unlock()
+	health.failed, health.nextRetry = false, time.Time{}
+}
+
+// isUnavailable is whether the cluster has nothing worth showing, see the comment at the top.
+// The caller holds the lock.
+func (health *clusterHealth) isUnavailable(synced bool) bool {
+	return health.failed || (!synced && health.lastError != "" && !health.connected)
+}
+
+// fill adds the health to a status that already has Synced set
+func (health *clusterHealth) fill(status *ClusterStatus) {
+	health.mutx.Lock()
+	defer health.mutx.Unlock()
+	status.Connected, status.LastError, status.ServerVersion = health.connected, health.lastError, health.serverVersion
+	if !health.lastList.IsZero() {
+		lastList := health.lastList
+		status.LastSuccessfulList = &lastList
+	}
+	if !health.lastErrorTime.IsZero() {
+		lastErrorTime := health.lastErrorTime
+		status.LastErrorTime = &lastErrorTime
+	}
+	if !health.nextRetry.IsZero() {
+		nextRetry := health.nextRetry
+		status.NextRetry = &nextRetry
+	}
+	switch {
+	case health.isUnavailable(status.Synced):
+		status.State = clusterUnavailable
+	case status.Synced && health.lastError != "" && !health.connected:
+		status.State = clusterDegraded
+	case status.Synced:
+		status.State = clusterReady
+	default:
+		status.State = clusterSyncing
+	}
+}
+
+func registerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(writer http.ResponseWriter, req *http.Request) {
+		writeJSON(writer, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(writer http.ResponseWriter, req *http.Request) {
+		report := healthReport(Controllers.statuses(), Controllers.isStartedUp())
+		status := http.StatusOK
+		if report.Status == "starting" || report.Status == clusterUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(writer, status, report)
+	})
+}
+
+// healthReport is ok when every cluster is ready, degraded when only some of them are serving
+// data and unavailable when none of them are
+func healthReport(statuses []ClusterStatus, startedUp bool) HealthReport {
+	report := HealthReport{Status: "ok", Clusters: statuses}
+	if !startedUp {
+		report.Status = "starting"
+		return report
+	}
+	serving := 0
+	for _, status := range statuses {
+		if status.State == clusterReady || status.State == clusterDegraded {
+			serving++
+		}
+		if status.State != clusterReady {
+			report.Status = clusterDegraded
+		}
+	}
+	if len(statuses) > 0 && serving == 0 {
+		report.Status = clusterUnavailable
+	}
+	return report
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+/*
+	The store only knows what's running right now. Promotion (promotion.go) also needs to know
+	what ran before and since when: a version that went through staging last week and was then
+	replaced still counts as having been through staging.
+
+	So every sync records the first time each version of each container was seen in a cluster.
+	Versions are keyed by versionKey, so with mirrors or matchDigests a version pulled under a
+	different name is still the same version. This is kept in memory, and also on disk along
+	with every change to every workload when there's a history store (see historystore.go).
+	Without one, after a restart the clock starts over from whatever is running at the time.
+
+	A service's times are dropped once nothing in the cluster goes by it anymore, and a cluster's
+	once it's removed, so a long running process doesn't keep everything it ever saw.
+*/
+
+type historyKey struct {
+	Cluster   string
+	Service   string
+	Container string
+	Version   string
+}
+
+type VersionHistory struct {
+	firstSeen map[historyKey]time.Time
+	// nil unless the config has a history section
+	db   *historyDB
+	mutx sync.Mutex
+}
+
+var versionHistory = newVersionHistory()
+
+func newVersionHistory() *VersionHistory {
+	return &VersionHistory{firstSeen: make(map[historyKey]time.Time)}
+}
+
+// useStore keeps the history in db from now on, and picks up what it had from before
+func (history *VersionHistory) useStore(db *historyDB) error {
+	firstSeen, err := db.loadFirstSeen()
+	if err != nil {
+		return err
+	}
+	history.mutx.Lock()
+	defer history.mutx.Unlock()
+	for key, at := range firstSeen {
+		if seen, exists := history.firstSeen[key]; !exists || at.Before(seen) {
+			history.firstSeen[key] = at
+		}
+	}
+	history.db = db
+	return nil
+}
+
+func (history *VersionHistory) store() *historyDB {
+	history.mutx.Lock()
+	defer history.mutx.Unlock()
+	return history.db
+}
+
+// record notes the containers' versions as seen at now, unless they were seen before
+func (history *VersionHistory) record(cluster, service string, containers []ContainerInfo, now time.Time) {
+	history.mutx.Lock()
+	defer history.mutx.Unlock()
+	added := make(map[historyKey]time.Time)
+	for _, container := range containers {
+		key := historyKey{Cluster: cluster, Service: service, Container: container.Name, Version: container.versionKey()}
+		if _, seen := history.firstSeen[key]; !seen {
+			history.firstSeen[key] = now
+			added[key] = now
+		}
+	}
+	if history.db != nil && len(added) > 0 {
+		if err := history.db.saveFirstSeen(added); err != nil {
+			klog.ErrorS(err, "Couldn't write to the history store", "cluster", cluster, "service", service)
+		}
+	}
+}
+
+// observe records the workload's containers as seen at now, and the change if they changed
+func (history *VersionHistory) observe(cluster string, key WorkloadKey, containers []ContainerInfo, now time.Time) {
+	// a workload the controller hasn't synced yet has no containers, that's not a change
+	if len(containers) == 0 {
+		return
+	}
+	history.record(cluster, serviceKey(key), containers, now)
+	if db := history.store(); db != nil {
+		if err := db.observe(newHistoryRecord(cluster, key, containers, now)); err != nil {
+			klog.ErrorS(err, "Couldn't write to the history store", "cluster", cluster, "key", key)
+		}
+	}
+}
+
+// deleted records the workload as gone, serviceGone is whether it was the last one in the
+// cluster going by its service key
+func (history *VersionHistory) deleted(cluster string, key WorkloadKey, serviceGone bool, now time.Time) {
+	if serviceGone {
+		service := serviceKey(key)
+		history.forget(func(key historyKey) bool { return key.Cluster == cluster && key.Service == service })
+	}
+	if db := history.store(); db != nil {
+		record := HistoryRecord{Time: now, Cluster: cluster, Kind: key.Kind, Namespace: key.Namespace, Name: key.Name, Deleted: true}
+		if err := db.observe(record); err != nil {
+			klog.ErrorS(err, "Couldn't write to the history store", "cluster", cluster, "key", key)
+		}
+	}
+}
+
+// synced is called once a source has caught up, whatever it had last time that isn't in
+// present got deleted while we weren't looking
+func (history *VersionHistory) synced(cluster string, present map[WorkloadKey]bool, now time.Time) {
+	services := make(map[string]bool)
+	for key := range present {
+		services[serviceKey(key)] = true
+	}
+	history.forget(func(key historyKey) bool { return key.Cluster == cluster && !services[key.Service] })
+	if db := history.store(); db != nil {
+		if err := db.synced(cluster, present, now); err != nil {
+			klog.ErrorS(err, "Couldn't write to the history store", "cluster", cluster)
+		}
+	}
+}
+
+// forgetCluster drops everything about a cluster that isn't watched anymore
+func (history *VersionHistory) forgetCluster(cluster string) {
+	history.forget(func(key historyKey) bool { return key.Cluster == cluster })
+}
+
+// forget drops the first-seen times that match, from the history store too
+func (history *VersionHistory) forget(matches func(key historyKey) bool) {
+	history.mutx.Lock()
+	defer history.mutx.Unlock()
+	var gone []historyKey
+	for key := range history.firstSeen {
+		if matches(key) {
+			delete(history.firstSeen, key)
+			gone = append(gone, key)
+		}
+	}
+	if history.db != nil && len(gone) > 0 {
+		if err := history.db.deleteFirstSeen(gone); err != nil {
+			klog.ErrorS(err, "Couldn't write to the history store")
+		}
+	}
+}
+
+// compact compacts the history store and drops the first-seen times it dropped from memory
+// too, so what's in memory is what a restart would load
+func (history *VersionHistory) compact(now time.Time) (int, error) {
+	history.mutx.Lock()
+	defer history.mutx.Unlock()
+	if history.db == nil {
+		return 0, nil
+	}
+	removed, unused, err := history.db.compact(now)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range unused {
+		delete(history.firstSeen, key)
+	}
+	return removed, nil
+}
+
+// runCompaction compacts every compactionInterval of the history store until ctx is done
+func (history *VersionHistory) runCompaction(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	db := history.store()
+	if db == nil {
+		return
+	}
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		removed, err := history.compact(time.Now())
+		if err != nil {
+			logger.Error(err, "Couldn't compact the history store")
+			return
+		}
+		if removed > 0 {
+			logger.Info("Compacted the history store", "removed", removed)
+		}
+	}, db.config.compactionInterval())
+}
+
+// seen is when the version of the container was first seen in the cluster
+func (history *VersionHistory) seen(cluster, service, container, version string) (time.Time, bool) {
+	history.mutx.Lock()
+	defer history.mutx.Unlock()
+	at, seen := history.firstSeen[historyKey{Cluster: cluster, Service: service, Container: container, Version: version}]
+	return at, seen
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/*
+	Everything else is in memory, so without this a restart forgets what ran where and when.
+	With a history section in the config file every change to a workload's images (and the
+	digests its pods run) is written to a bbolt file, along with the first-seen times from
+	history.go:
+
+	history:
+	  path: ./history.db
+	  # changes older than this get compacted, 720h (30 days) if it's left out
+	  retention: 720h
+	  # how often to compact, 1h if it's left out
+	  compactionInterval: 1h
+
+	Buckets:
+		changes    - every change in the order it happened, keyed by time so a time range is
+		             one cursor walk. A change is the workload's containers after it, or a
+		             deletion.
+		latest     - the last change of each workload, to tell whether the next sync changed
+		             anything (also across restarts)
+		firstSeen  - when each version was first seen in each cluster
+
+	Compacting drops the changes older than the retention, except for the last one of each
+	workload that was still around at the time, so what was running at any point in the
+	retention can still be worked out. First-seen times that nothing kept refers to anymore go
+	too. Workloads that got deleted while kubetroller was down are noticed (and recorded as
+	deleted) when their cluster has synced again.
+*/
+
+const (
+	defaultHistoryRetention  = 30 * 24 * time.Hour
+	defaultHistoryCompaction = time.Hour
+)
+
+var (
+	bucketChanges   = []byte("changes")
+	bucketLatest    = []byte("latest")
+	bucketFirstSeen = []byte("firstSeen")
+)
+
+type HistoryConfig struct {
+	Path               string           `json:"path"`
+	Retention          *metav1.Duration `json:"retention,omitempty"`
+	CompactionInterval *metav1.Duration `json:"compactionInterval,omitempty"`
+}
+
+func validateHistoryConfig(history *HistoryConfig) error {
+	var problems []string
+	if history.Path == "" {
+		problems = append(problems, "history.path is required")
+	}
+	if history.Retention != nil && history.Retention.Duration <= 0 {
+		problems = append(problems, "history.retention has to be more than 0")
+	}
+	if history.CompactionInterval != nil && history.CompactionInterval.Duration <= 0 {
+		problems = append(problems, "history.compactionInterval has to be more than 0")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func (history HistoryConfig) retention() time.Duration {
+	if history.Retention == nil {
+		return defaultHistoryRetention
+	}
+	return history.Retention.Duration
+}
+
+func (history HistoryConfig) compactionInterval() time.Duration {
+	if history.CompactionInterval == nil {
+		return defaultHistoryCompaction
+	}
+	return history.CompactionInterval.Duration
+}
+
+// HistoryRecord is one change to a workload
+type HistoryRecord struct {
+	Time       time.Time          `json:"time"`
+	Cluster    string             `json:"cluster"`
+	Kind       string             `json:"kind"`
+	Namespace  string             `json:"namespace"`
+	Name       string             `json:"name"`
+	Containers []HistoryContainer `json:"containers,omitempty"`
+	Deleted    bool               `json:"deleted,omitempty"`
+}
+
+// HistoryContainer is the part of a ContainerInfo that's worth keeping
+type HistoryContainer struct {
+	Name      string   `json:"name"`
+	Image     string   `json:"image"`
+	Init      bool     `json:"init,omitempty"`
+	Ephemeral bool     `json:"ephemeral,omitempty"`
+	Digests   []string `json:"digests,omitempty"`
+}
+
+func newHistoryRecord(cluster string, key WorkloadKey, containers []ContainerInfo, at time.Time) HistoryRecord {
+	record := HistoryRecord{Time: at, Cluster: cluster, Kind: key.Kind, Namespace: key.Namespace, Name: key.Name}
+	for _, container := range containers {
+		record.Containers = append(record.Containers, HistoryContainer{
+			Name:      container.Name,
+			Image:     container.Image,
+			Init:      container.Init,
+			Ephemeral: container.Ephemeral,
+			Digests:   container.Digests,
+		})
+	}
+	return record
+}
+
+func (record HistoryRecord) key() WorkloadKey {
+	return WorkloadKey{Kind: record.Kind, Namespace: record.Namespace, Name: record.Name}
+}
+
+// containers turns the record back into the ContainerInfos it was made from
+func (record HistoryRecord) containers() []ContainerInfo {
+	containers := make([]ContainerInfo, 0, len(record.Containers))
+	for _, container := range record.Containers {
+		info := newContainerInfo(container.Name, container.Image, container.Init, container.Ephemeral)
+		info.Digests = container.Digests
+		info.MixedDigests = len(container.Digests) > 1
+		containers = append(containers, info)
+	}
+	return containers
+}
+
+// sameAs says whether nothing worth recording changed between the two
+func (record HistoryRecord) sameAs(other HistoryRecord) bool {
+	return record.Deleted == other.Deleted && slices.EqualFunc(record.Containers, other.Containers, func(a, b HistoryContainer) bool {
+		return a.Name == b.Name && a.Image == b.Image && a.Init == b.Init && a.Ephemeral == b.Ephemeral && slices.Equal(a.Digests, b.Digests)
+	})
+}
+
+type historyDB struct {
+	db     *bolt.DB
+	config HistoryConfig
+	// the latest bucket, kept in memory so most syncs don't need to touch the file
+	latest map[string]HistoryRecord
+	mutx   sync.Mutex
+}
+
+func openHistoryDB(config HistoryConfig) (*historyDB, error) {
+	db, err := bolt.Open(config.Path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening history store %s: %w", config.Path, err)
+	}
+	history := &historyDB{db: db, config: config, latest: make(map[string]HistoryRecord)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketChanges, bucketLatest, bucketFirstSeen} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketLatest).ForEach(func(key, value []byte) error {
+			var record HistoryRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			history.latest[string(key)] = record
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("reading history store %s: %w", config.Path, err)
+	}
+	return history, nil
+}
+
+func (history *historyDB) close() error {
+	return history.db.Close()
+}
+
+func latestKey(cluster string, key WorkloadKey) string {
+	return strings.Join([]string{cluster, key.Kind, key.Namespace, key.Name}, "\x00")
+}
+
+func firstSeenKey(key historyKey) []byte {
+	return []byte(strings.Join([]string{key.Cluster, key.Service, key.Container, key.Version}, "\x00"))
+}
+
+func parseFirstSeenKey(raw []byte) (historyKey, bool) {
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 4 {
+		return historyKey{}, false
+	}
+	return historyKey{Cluster: parts[0], Service: parts[1], Container: parts[2], Version: parts[3]}, true
+}
+
+// changeKey sorts by time, with the sequence after it so two changes in the same nanosecond don't collide
+func changeKey(at time.Time, sequence uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(at.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], sequence)
+	return key
+}
+
+func timeKey(at time.Time) []byte {
+	return changeKey(at, 0)
+}
+
+// observe records the workload's containers if they changed since the last time
+func (history *historyDB) observe(record HistoryRecord) error {
+	key := latestKey(record.Cluster, record.key())
+	history.mutx.Lock()
+	defer history.mutx.Unlock()
+	previous, exists := history.latest[key]
+	if exists && previous.sameAs(record) {
+		return nil
+	}
+	// a workload we never had is only worth a deletion if we knew about it
+	if record.Deleted && (!exists || previous.Deleted) {
+		return nil
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = history.db.Update(func(tx *bolt.Tx) error {
+		changes := tx.Bucket(bucketChanges)
+		sequence, err := changes.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := changes.Put(changeKey(record.Time, sequence), value); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketLatest).Put([]byte(key), value)
+	})
+	if err != nil {
+		return err
+	}
+	history.latest[key] = record
+	return nil
+}
+
+// synced records the workloads of the cluster that were there last time but aren't anymore
+func (history *historyDB) synced(cluster string, present map[WorkloadKey]bool, at time.Time) error {
+	history.mutx.Lock()
+	var gone []HistoryRecord
+	for _, record := range history.latest {
+		if record.Cluster == cluster && !record.Deleted && !present[record.key()] {
+			gone = append(gone, HistoryRecord{Time: at, Cluster: cluster, Kind: record.Kind, Namespace: record.Namespace, Name: record.Name, Deleted: true})
+		}
+	}
+	history.mutx.Unlock()
+
+	var errs []error
+	for _, record := range gone {
+		errs = append(errs, history.observe(record))
+	}
+	return errors.Join(errs...)
+}
+
+func (history *historyDB) saveFirstSeen(firstSeen map[historyKey]time.Time) error {
+	return history.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketFirstSeen)
+		for key, at := range firstSeen {
+			value, err := at.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(firstSeenKey(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (history *historyDB) deleteFirstSeen(keys []historyKey) error {
+	return history.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketFirstSeen)
+		for _, key := range keys {
+			if err := bucket.Delete(firstSeenKey(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (history *historyDB) loadFirstSeen() (map[historyKey]time.Time, error) {
+	firstSeen := make(map[historyKey]time.Time)
+	err := history.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFirstSeen).ForEach(func(raw, value []byte) error {
+			key, ok := parseFirstSeenKey(raw)
+			var at time.Time
+			if !ok || at.UnmarshalBinary(value) != nil {
+				// something we can't read isn't worth failing over
+				return nil
+			}
+			firstSeen[key] = at
+			return nil
+		})
+	})
+	return firstSeen, err
+}
+
+// changes is every change from from up to (not including) to, oldest first. A zero from is
+// the start of what's kept.
+func (history *historyDB) changes(from, to time.Time) ([]HistoryRecord, error) {
+	records := []HistoryRecord{}
+	err := history.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucketChanges).Cursor()
+		key, value := cursor.First()
+		if !from.IsZero() {
+			key, value = cursor.Seek(timeKey(from))
+		}
+		end := timeKey(to)
+		for ; key != nil && bytes.Compare(key, end) < 0; key, value = cursor.Next() {
+			var record HistoryRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// compact drops what's older than the retention, see the comment at the top. It returns how
+// many changes went and the first-seen times that did, for VersionHistory to drop as well.
+func (history *historyDB) compact(now time.Time) (int, []historyKey, error) {
+	cutoff := timeKey(now.Add(-history.config.retention()))
+	removed := 0
+	var unusedKeys []historyKey
+	err := history.db.Update(func(tx *bolt.Tx) error {
+		changes := tx.Bucket(bucketChanges)
+		// the last change before the cutoff of every workload, the older ones can go
+		last := make(map[string][]byte)
+		var old [][]byte
+		cursor := changes.Cursor()
+		for key, value := cursor.First(); key != nil && bytes.Compare(key, cutoff) < 0; key, value = cursor.Next() {
+			var record HistoryRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			workload := latestKey(record.Cluster, record.key())
+			if previous, exists := last[workload]; exists {
+				old = append(old, previous)
+			}
+			last[workload] = slices.Clone(key)
+			if record.Deleted {
+				// nothing to work out from a deletion that's past the retention
+				old = append(old, last[workload])
+				delete(last, workload)
+			}
+		}
+		for _, key := range old {
+			if err := changes.Delete(key); err != nil {
+				return err
+			}
+		}
+		removed = len(old)
+
+		// first-seen times are kept while anything left still has that version
+		inUse := make(map[historyKey]bool)
+		err := changes.ForEach(func(key, value []byte) error {
+			var record HistoryRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			service := serviceKey(record.key())
+			for _, container := range record.containers() {
+				inUse[historyKey{Cluster: record.Cluster, Service: service, Container: container.Name, Version: container.versionKey()}] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		firstSeen := tx.Bucket(bucketFirstSeen)
+		var unused [][]byte
+		cutoffTime := now.Add(-history.config.retention())
+		err = firstSeen.ForEach(func(raw, value []byte) error {
+			key, ok := parseFirstSeenKey(raw)
+			var at time.Time
+			if ok && at.UnmarshalBinary(value) == nil && (at.After(cutoffTime) || inUse[key]) {
+				return nil
+			}
+			unused = append(unused, slices.Clone(raw))
+			if ok {
+				unusedKeys = append(unusedKeys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range unused {
+			if err := firstSeen.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return removed, unusedKeys, nil
+}
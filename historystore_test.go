@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func openTestHistory(t *testing.T, config HistoryConfig) (*historyDB, *VersionHistory) {
+	t.Helper()
+	db, err := openHistoryDB(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := newVersionHistory()
+	if err := history.useStore(db); err != nil {
+		t.Fatal(err)
+	}
+	return db, history
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	config := HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db"), Retention: &metav1.Duration{Duration: 24 * time.Hour}}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	api := WorkloadKey{Kind: "Deployment", Namespace: "default", Name: "api"}
+	old := WorkloadKey{Kind: "Deployment", Namespace: "default", Name: "old"}
+	image := func(image string) []ContainerInfo {
+		return []ContainerInfo{newContainerInfo("web", image, false, false)}
+	}
+	version := func(image string) string {
+		return newContainerInfo("web", image, false, false).versionKey()
+	}
+
+	db, history := openTestHistory(t, config)
+	history.observe("prod", api, image("nginx:1.24"), now.Add(-72*time.Hour))
+	history.observe("prod", old, image("busybox:1.0"), now.Add(-60*time.Hour))
+	history.deleted("prod", old, true, now.Add(-50*time.Hour))
+	history.observe("prod", api, image("nginx:1.25"), now.Add(-48*time.Hour))
+	history.observe("prod", api, image("nginx:1.26"), now.Add(-time.Hour))
+
+	// 1.24 and both changes of old are past the retention, 1.25 is what ran when it started
+	removed, err := history.compact(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("compaction removed %d changes, want 3", removed)
+	}
+	if _, seen := history.seen("prod", serviceKey(api), "web", version("nginx:1.24")); seen {
+		t.Errorf("compaction left the first-seen time of nginx:1.24 in memory")
+	}
+	if err := db.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart only has what's in the file
+	db, history = openTestHistory(t, config)
+	defer db.close()
+	cases := []struct {
+		image string
+		since time.Time
+		seen  bool
+	}{
+		{"nginx:1.24", time.Time{}, false},
+		{"nginx:1.25", now.Add(-48 * time.Hour), true},
+		{"nginx:1.26", now.Add(-time.Hour), true},
+	}
+	for _, test := range cases {
+		since, seen := history.seen("prod", serviceKey(api), "web", version(test.image))
+		if seen != test.seen || !since.Equal(test.since) {
+			t.Errorf("after a restart %s was first seen %s (%t), want %s (%t)", test.image, since, seen, test.since, test.seen)
+		}
+	}
+
+	records, err := db.changes(time.Time{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("%d changes are left, want 2: %+v", len(records), records)
+	}
+	for _, replay := range []struct {
+		at    time.Time
+		image string
+	}{
+		{now.Add(-24 * time.Hour), "nginx:1.25"},
+		{now, "nginx:1.26"},
+	} {
+		var upTo []HistoryRecord
+		for _, record := range records {
+			if record.Time.Before(replay.at) {
+				upTo = append(upTo, record)
+			}
+		}
+		snapshots := historySnapshots(upTo, nil)
+		if len(snapshots) != 1 || len(snapshots[0].Workloads) != 1 {
+			t.Fatalf("replaying up to %s = %+v, want only prod's api", replay.at, snapshots)
+		}
+		if running := snapshots[0].Workloads[api].Containers; len(running) != 1 || running[0].Image != replay.image {
+			t.Errorf("replaying up to %s ran %+v, want %s", replay.at, running, replay.image)
+		}
+	}
+
+	// the latest change of each workload is loaded again, so seeing it again isn't a change
+	history.observe("prod", api, image("nginx:1.26"), now)
+	if records, err := db.changes(time.Time{}, now.Add(time.Hour)); err != nil || len(records) != 2 {
+		t.Errorf("seeing the same version after a restart left %d changes (%v), want 2", len(records), err)
+	}
+}
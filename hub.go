@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+/*
+	In hub mode kubetroller runs inside one cluster (the hub) and finds the clusters it should
+	watch (the members) by looking for Secrets with a label on them, instead of having their
+	kubeconfigs copied into the image. Creating, changing or deleting one of those Secrets
+	starts, restarts or stops the controller for that member while we keep running.
+
+	A member Secret looks like this:
+
+	apiVersion: v1
+	kind: Secret
+	metadata:
+	  name: prod-eu
+	  namespace: kubetroller
+	  labels:
+	    kubetroller.io/cluster: "true"
+	  annotations:
+	    kubetroller.io/cluster-name: prod-eu       # optional, defaults to the Secret's name
+	    kubetroller.io/context: admin@prod-eu      # optional, only for the kubeconfig key
+	    kubetroller.io/namespaces: default,payments # optional, defaults to every namespace
+	    kubetroller.io/labels: env=prod,region=eu   # optional display labels
+	    kubetroller.io/kinds: Deployment,CronJob    # optional, defaults to every kind
+	stringData:
+	  kubeconfig: |                                # either a whole kubeconfig...
+	    ...
+	  server: https://prod-eu.example.com:6443     # ...or a server, a bearer token and a CA
+	  token: eyJhbGciOi...
+	  ca.crt: |
+	    -----BEGIN CERTIFICATE-----
+
+	The hub section of the config file (or -hub for the defaults) looks like:
+
+	hub:
+	  kubeconfig: ./hub.kubeconfig # optional, defaults to the in-cluster config
+	  namespace: kubetroller       # optional, defaults to the namespace we're running in
+	  selector: kubetroller.io/cluster=true
+	  resyncPeriod: 1m             # any of the per-cluster settings are defaults for every member
+*/
+
+const (
+	defaultHubSelector = "kubetroller.io/cluster=true"
+
+	annotationClusterName = "kubetroller.io/cluster-name"
+	annotationContext     = "kubetroller.io/context"
+	annotationNamespaces  = "kubetroller.io/namespaces"
+	annotationLabels      = "kubetroller.io/labels"
+	annotationKinds       = "kubetroller.io/kinds"
+
+	secretKeyKubeconfig = "kubeconfig"
+	secretKeyServer     = "server"
+	secretKeyToken      = "token"
+	secretKeyCA         = "ca.crt"
+	secretKeyInsecure   = "insecure-skip-tls-verify"
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+type HubConfig struct {
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Selector   string `json:"selector,omitempty"`
+	ClusterSettings
+}
+
+type Hub struct {
+	config       *HubConfig
+	client       kubernetes.Interface
+	factory      kubeinformers.SharedInformerFactory
+	secretLister corelisters.SecretLister
+	secretSynced cache.InformerSynced
+	workqueue    workqueue.TypedRateLimitingInterface[cache.ObjectName]
+	recorder     record.EventRecorder
+	// which cluster each Secret started, and the resource version it was started from
+	registered map[cache.ObjectName]hubMember
+}
+
+type hubMember struct {
+	clusterName     string
+	resourceVersion string
+}
+
+func validateHubConfig(hub *HubConfig) error {
+	var errs []error
+	if hub.Selector != "" {
+		if _, err := labels.Parse(hub.Selector); err != nil {
+			errs = append(errs, fmt.Errorf("hub.selector %q isn't a valid label selector: %s", hub.Selector, err.Error()))
+		}
+	}
+	if hub.Namespace != "" {
+		if problems := validation.IsDNS1123Label(hub.Namespace); len(problems) > 0 {
+			errs = append(errs, fmt.Errorf("hub.namespace %q isn't a valid namespace name: %s", hub.Namespace, strings.Join(problems, ", ")))
+		}
+	}
+	if hub.Kubeconfig != "" {
+		if _, err := os.Stat(hub.Kubeconfig); err != nil {
+			errs = append(errs, fmt.Errorf("hub.kubeconfig %s can't be read: %s", hub.Kubeconfig, err.Error()))
+		}
+	}
+	// the settings get checked the same way as any other cluster's
+	if err := validateClusterConfigs([]ClusterConfig{{Name: "hub defaults", ClusterSettings: hub.ClusterSettings}}); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func NewHub(ctx context.Context, config *HubConfig) (*Hub, error) {
+	logger := klog.FromContext(ctx)
+
+	hubCluster := ClusterConfig{Name: "hub", Kubeconfig: config.Kubeconfig, Context: config.Context}
+	restConfig, err := hubCluster.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = currentNamespace()
+	}
+	selector := config.Selector
+	if selector == "" {
+		selector = defaultHubSelector
+	}
+	logger.Info("Watching for member cluster secrets", "namespace", namespace, "selector", selector)
+
+	eventBroadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	eventBroadcaster.StartStructuredLogging(0)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+
+	factory := kubeinformers.NewSharedInformerFactoryWithOptions(clientset, config.resyncPeriod(),
+		kubeinformers.WithNamespace(namespace),
+		kubeinformers.WithTweakListOptions(func(options *v1.ListOptions) {
+			options.LabelSelector = selector
+		}),
+	)
+	secretInformer := factory.Core().V1().Secrets()
+
+	hub := &Hub{
+		config:       config,
+		client:       clientset,
+		factory:      factory,
+		secretLister: secretInformer.Lister(),
+		secretSynced: secretInformer.Informer().HasSynced,
+		workqueue: workqueue.NewTypedRateLimitingQueue(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[cache.ObjectName](time.Second, 5*time.Minute),
+		),
+		recorder:   eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "kubetroller-hub"}),
+		registered: make(map[cache.ObjectName]hubMember),
+	}
+
+	secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: hub.enqueueSecret,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			hub.enqueueSecret(newObj)
+		},
+		DeleteFunc: hub.enqueueSecret,
+	})
+
+	return hub, nil
+}
+
+func (config *HubConfig) resyncPeriod() time.Duration {
+	settings := ClusterConfig{ClusterSettings: config.ClusterSettings}
+	return settings.resyncPeriod()
+}
+
+// runHub connects to the hub and watches it until ctx is done, retrying like the clusters do
+// when the hub can't be reached
+func runHub(ctx context.Context, config *HubConfig) {
+	logger := klog.FromContext(ctx)
+	backoff := retryBackoff()
+	for {
+		hub, err := NewHub(ctx, config)
+		if err == nil {
+			err = hub.Run(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		delay := backoff.Step()
+		logger.Error(err, "Trouble connecting to the hub cluster, retrying", "in", delay.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (hub *Hub) Run(ctx context.Context) error {
+	defer utilruntime.HandleCrash()
+	defer hub.workqueue.ShutDown()
+	logger := klog.FromContext(ctx)
+
+	hub.factory.Start(ctx.Done())
+	if ok := cache.WaitForCacheSync(ctx.Done(), hub.secretSynced); !ok {
+		return errors.New("failed to wait for the hub's secret cache to sync")
+	}
+
+	// a single worker keeps starting and stopping clusters in order
+	go wait.UntilWithContext(ctx, hub.runWorker, time.Second)
+
+	logger.Info("Started hub worker")
+	<-ctx.Done()
+	logger.Info("Shutting down hub worker")
+	return nil
+}
+
+func (hub *Hub) runWorker(ctx context.Context) {
+	for hub.processNextWorkItem(ctx) {
+	}
+}
+
+func (hub *Hub) processNextWorkItem(ctx context.Context) bool {
+	objRef, shutdown := hub.workqueue.Get()
+	if shutdown {
+		return false
+	}
+	defer hub.workqueue.Done(objRef)
+
+	if err := hub.syncSecret(ctx, objRef); err != nil {
+		utilruntime.HandleErrorWithContext(ctx, err, "Error syncing member cluster secret; requeuing for later retry", "objectReference", objRef)
+		hub.workqueue.AddRateLimited(objRef)
+		return true
+	}
+
+	hub.workqueue.Forget(objRef)
+	return true
+}
+
+func (hub *Hub) enqueueSecret(obj interface{}) {
+	if objRef, err := cache.DeletionHandlingObjectToName(obj); err != nil {
+		utilruntime.HandleError(err)
+	} else {
+		hub.workqueue.Add(objRef)
+	}
+}
+
+// syncSecret makes the running controllers match what the Secret says
+func (hub *Hub) syncSecret(ctx context.Context, objRef cache.ObjectName) error {
+	logger := klog.FromContext(ctx)
+	member, registered := hub.registered[objRef]
+
+	secret, err := hub.secretLister.Secrets(objRef.Namespace).Get(objRef.Name)
+	if apierrors.IsNotFound(err) {
+		if registered {
+			logger.Info("Member cluster secret deleted, stopping its controller", "secret", objRef, "cluster", member.clusterName)
+			Controllers.remove(member.clusterName)
+			delete(hub.registered, objRef)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if registered && member.resourceVersion == secret.ResourceVersion {
+		if _, running := Controllers.get(member.clusterName); running {
+			return nil
+		}
+	}
+
+	config, err := clusterConfigFromSecret(secret, hub.config.ClusterSettings)
+	if err != nil {
+		// there's no point retrying until somebody fixes the secret, which will requeue it anyway
+		hub.recorder.Eventf(secret, corev1.EventTypeWarning, "InvalidClusterSecret", "Not registering cluster: %s", err.Error())
+		logger.Error(err, "Invalid member cluster secret", "secret", objRef)
+		if registered {
+			Controllers.stop(member.clusterName)
+			delete(hub.registered, objRef)
+		}
+		return nil
+	}
+
+	// something changed, so start over with the new credentials
+	if registered {
+		logger.Info("Member cluster secret changed, restarting its controller", "secret", objRef, "cluster", member.clusterName)
+		Controllers.stop(member.clusterName)
+		delete(hub.registered, objRef)
+	}
+
+	if err := Controllers.start(ctx, config, sourceHub); err != nil {
+		hub.recorder.Eventf(secret, corev1.EventTypeWarning, "ClusterRegistrationFailed", "Couldn't start cluster %s: %s", config.Name, err.Error())
+		return err
+	}
+
+	hub.registered[objRef] = hubMember{clusterName: config.Name, resourceVersion: secret.ResourceVersion}
+	hub.recorder.Eventf(secret, corev1.EventTypeNormal, "ClusterRegistered", "Watching cluster %s", config.Name)
+	return nil
+}
+
+func clusterConfigFromSecret(secret *corev1.Secret, defaults ClusterSettings) (ClusterConfig, error) {
+	config := ClusterConfig{
+		Name:            secret.Name,
+		ClusterSettings: defaults,
+	}
+	if name := secret.Annotations[annotationClusterName]; name != "" {
+		config.Name = name
+	}
+	if namespaces := secret.Annotations[annotationNamespaces]; namespaces != "" {
+		config.Namespaces = splitList(namespaces)
+	}
+	if displayLabels := secret.Annotations[annotationLabels]; displayLabels != "" {
+		parsed, err := labels.ConvertSelectorToLabelsMap(displayLabels)
+		if err != nil {
+			return config, fmt.Errorf("annotation %s: %w", annotationLabels, err)
+		}
+		config.Labels = parsed
+	}
+	if kinds := secret.Annotations[annotationKinds]; kinds != "" {
+		config.Kinds = splitList(kinds)
+	}
+
+	var restConfig *rest.Config
+	if kubeconfig, exists := secret.Data[secretKeyKubeconfig]; exists {
+		clientConfig, err := clientcmd.NewClientConfigFromBytes(kubeconfig)
+		if err != nil {
+			return config, fmt.Errorf("key %s isn't a valid kubeconfig: %w", secretKeyKubeconfig, err)
+		}
+		if context := secret.Annotations[annotationContext]; context != "" {
+			rawConfig, err := clientConfig.RawConfig()
+			if err != nil {
+				return config, fmt.Errorf("key %s isn't a valid kubeconfig: %w", secretKeyKubeconfig, err)
+			}
+			if _, exists := rawConfig.Contexts[context]; !exists {
+				return config, fmt.Errorf("context %q from annotation %s doesn't exist in the kubeconfig", context, annotationContext)
+			}
+			clientConfig = clientcmd.NewNonInteractiveClientConfig(rawConfig, context, &clientcmd.ConfigOverrides{}, nil)
+		}
+		restConfig, err = clientConfig.ClientConfig()
+		if err != nil {
+			return config, fmt.Errorf("key %s: %w", secretKeyKubeconfig, err)
+		}
+	} else {
+		server := strings.TrimSpace(string(secret.Data[secretKeyServer]))
+		token := strings.TrimSpace(string(secret.Data[secretKeyToken]))
+		if server == "" || token == "" {
+			return config, fmt.Errorf("needs either a %s key or both %s and %s keys", secretKeyKubeconfig, secretKeyServer, secretKeyToken)
+		}
+		restConfig = &rest.Config{
+			Host:        server,
+			BearerToken: token,
+			TLSClientConfig: rest.TLSClientConfig{
+				CAData:   secret.Data[secretKeyCA],
+				Insecure: strings.TrimSpace(string(secret.Data[secretKeyInsecure])) == "true",
+			},
+		}
+	}
+	config.rest = restConfig
+
+	if err := validateClusterConfigs([]ClusterConfig{config}); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// currentNamespace is the namespace we're running in, when we're running in a pod
+func currentNamespace() string {
+	if bytes, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(bytes)); namespace != "" {
+			return namespace
+		}
+	}
+	return v1.NamespaceDefault
+}
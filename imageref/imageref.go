@@ -0,0 +1,217 @@
+// Package imageref parses container image references the way Docker does, so that nginx,
+// nginx:latest and docker.io/library/nginx:latest all come out as the same image.
+package imageref
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+	Splitting an image on ":" to get the tag (like exercises/client-go-practice/list.go used to)
+	breaks as soon as there's a registry with a port (localhost:5000/app:1.0) or a digest
+	(nginx@sha256:...), and comparing the strings as written makes nginx and
+	docker.io/library/nginx:latest look like two different versions. Everything that compares,
+	stores or shows images should go through Parse instead.
+
+	The rules are Docker's:
+		- the first part of the name is the registry if it has a "." or a ":" in it or is
+		  localhost, otherwise the registry is docker.io
+		- single name images on docker.io are in library/
+		- no tag and no digest means latest
+*/
+
+const (
+	DefaultRegistry = "docker.io"
+	DefaultTag      = "latest"
+
+	legacyRegistry  = "index.docker.io"
+	officialLibrary = "library/"
+)
+
+var (
+	ErrEmpty = errors.New("image reference is empty")
+
+	componentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	registryPattern  = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+	tagPattern       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is a parsed and normalized image reference. Tag is always set unless there's a
+// digest, in which case it's only set if the reference had both.
+type Reference struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// Parse normalizes an image reference like nginx, nginx:1.25, ghcr.io/org/app@sha256:... or
+// localhost:5000/app:dev
+func Parse(image string) (Reference, error) {
+	image = strings.TrimSpace(image)
+	if image == "" {
+		return Reference{}, ErrEmpty
+	}
+
+	var ref Reference
+	name := image
+	if at := strings.Index(name, "@"); at >= 0 {
+		ref.Digest = name[at+1:]
+		name = name[:at]
+		if !digestPattern.MatchString(ref.Digest) {
+			return Reference{}, fmt.Errorf("image reference %q: %q isn't a valid digest", image, ref.Digest)
+		}
+	}
+
+	// the tag is after the last colon, unless that colon is part of the registry's port
+	if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		ref.Tag = name[colon+1:]
+		name = name[:colon]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("image reference %q: %q isn't a valid tag", image, ref.Tag)
+		}
+	}
+
+	ref.Registry = DefaultRegistry
+	if slash := strings.Index(name, "/"); slash >= 0 {
+		first := name[:slash]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			if !registryPattern.MatchString(first) {
+				return Reference{}, fmt.Errorf("image reference %q: %q isn't a valid registry", image, first)
+			}
+			ref.Registry = first
+			name = name[slash+1:]
+		}
+	}
+	if ref.Registry == legacyRegistry {
+		ref.Registry = DefaultRegistry
+	}
+	if ref.Registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = officialLibrary + name
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if !componentPattern.MatchString(component) {
+			return Reference{}, fmt.Errorf("image reference %q: %q isn't a valid repository name", image, name)
+		}
+	}
+	ref.Repository = name
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+// Name is the registry and repository, without the tag or digest
+func (ref Reference) Name() string {
+	return ref.Registry + "/" + ref.Repository
+}
+
+// String is the fully qualified reference, docker.io/library/nginx:latest
+func (ref Reference) String() string {
+	return ref.Name() + ref.suffix()
+}
+
+// Familiar is the short form people write, nginx:latest, for showing to people
+func (ref Reference) Familiar() string {
+	name := ref.Name()
+	if ref.Registry == DefaultRegistry {
+		name = strings.TrimPrefix(ref.Repository, officialLibrary)
+	}
+	return name + ref.suffix()
+}
+
+// Version is the tag, or the digest when there's no tag
+func (ref Reference) Version() string {
+	if ref.Tag != "" {
+		return ref.Tag
+	}
+	return ref.Digest
+}
+
+func (ref Reference) suffix() string {
+	suffix := ""
+	if ref.Tag != "" {
+		suffix += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		suffix += "@" + ref.Digest
+	}
+	return suffix
+}
+
+// Normalize is String of the parsed reference, or the image unchanged if it can't be parsed
+// so a bad reference still shows up as something
+func Normalize(image string) string {
+	ref, err := Parse(image)
+	if err != nil {
+		return image
+	}
+	return ref.String()
+}
+
+// Familiar is like Normalize but for showing to people
+func Familiar(image string) string {
+	ref, err := Parse(image)
+	if err != nil {
+		return image
+	}
+	return ref.Familiar()
+}
+
+// Mirror says that images under Prefix are copies of the ones under Canonical, like
+// harbor.internal/mirror -> docker.io. Both are registry[/repository] prefixes and only match
+// whole path components, so harbor.internal/mirror doesn't match harbor.internal/mirrors/app.
+type Mirror struct {
+	Prefix    string `json:"prefix"`
+	Canonical string `json:"canonical"`
+}
+
+// Mirrors are tried longest prefix first
+type Mirrors []Mirror
+
+func (mirror Mirror) Validate() error {
+	for _, prefix := range []string{mirror.Prefix, mirror.Canonical} {
+		if prefix == "" {
+			return errors.New("mirrors need both a prefix and a canonical")
+		}
+		// a prefix is valid if something can live under it
+		if _, err := Parse(strings.TrimSuffix(prefix, "/") + "/image"); err != nil {
+			return fmt.Errorf("%q isn't a valid registry or repository prefix", prefix)
+		}
+	}
+	return nil
+}
+
+// Canonical rewrites a reference pulled through a mirror into the one it's a copy of. References
+// that don't match any mirror come back unchanged.
+func (mirrors Mirrors) Canonical(ref Reference) Reference {
+	name := ref.Name()
+	best := -1
+	for index, mirror := range mirrors {
+		prefix := strings.TrimSuffix(mirror.Prefix, "/")
+		if !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		if best < 0 || len(prefix) > len(strings.TrimSuffix(mirrors[best].Prefix, "/")) {
+			best = index
+		}
+	}
+	if best < 0 {
+		return ref
+	}
+
+	prefix := strings.TrimSuffix(mirrors[best].Prefix, "/")
+	rewritten := strings.TrimSuffix(mirrors[best].Canonical, "/") + "/" + strings.TrimPrefix(name, prefix+"/")
+	// parse it again so docker.io/nginx picks up library/ like any other image would
+	canonical, err := Parse(rewritten + ref.suffix())
+	if err != nil {
+		return ref
+	}
+	return canonical
+}
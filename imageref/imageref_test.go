@@ -0,0 +1,131 @@
+package imageref
+
+import (
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		image string
+		want  Reference
+	}{
+		{"nginx", Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "latest"}},
+		{"nginx:1.25", Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25"}},
+		{" nginx:1.25 ", Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25"}},
+		{"bitnami/redis:7.2", Reference{Registry: "docker.io", Repository: "bitnami/redis", Tag: "7.2"}},
+		{"docker.io/nginx", Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "latest"}},
+		{"index.docker.io/library/nginx:1.25", Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25"}},
+		{"index.docker.io/nginx", Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "latest"}},
+		{"ghcr.io/org/team/app:v2", Reference{Registry: "ghcr.io", Repository: "org/team/app", Tag: "v2"}},
+		{"localhost/app", Reference{Registry: "localhost", Repository: "app", Tag: "latest"}},
+		{"localhost:5000/app:dev", Reference{Registry: "localhost:5000", Repository: "app", Tag: "dev"}},
+		{"registry.example.com:8443/team/app", Reference{Registry: "registry.example.com:8443", Repository: "team/app", Tag: "latest"}},
+		{"[::1]:5000/app:1.0", Reference{Registry: "[::1]:5000", Repository: "app", Tag: "1.0"}},
+		{"[2001:db8::1]/team/app", Reference{Registry: "[2001:db8::1]", Repository: "team/app", Tag: "latest"}},
+		{"nginx@" + testDigest, Reference{Registry: "docker.io", Repository: "library/nginx", Digest: testDigest}},
+		{"nginx:1.25@" + testDigest, Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25", Digest: testDigest}},
+		{"localhost:5000/app@" + testDigest, Reference{Registry: "localhost:5000", Repository: "app", Digest: testDigest}},
+	}
+	for _, test := range cases {
+		ref, err := Parse(test.image)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.image, err)
+			continue
+		}
+		if ref != test.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.image, ref, test.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, image := range []string{
+		"",
+		"  ",
+		"Nginx",
+		"nginx:1.25:extra",
+		"myorg/MyApp:1.0",
+		"ghcr.io/Org/app",
+		"nginx:-bad",
+		"nginx@sha256:short",
+		"nginx@" + testDigest + "@" + testDigest,
+		"bad_registry.io:port/app",
+		"/app",
+		"app/",
+	} {
+		if ref, err := Parse(image); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", image, ref)
+		}
+	}
+}
+
+func TestStringAndFamiliar(t *testing.T) {
+	cases := []struct {
+		image, normalized, familiar string
+	}{
+		{"nginx", "docker.io/library/nginx:latest", "nginx:latest"},
+		{"index.docker.io/bitnami/redis:7.2", "docker.io/bitnami/redis:7.2", "bitnami/redis:7.2"},
+		{"localhost:5000/app", "localhost:5000/app:latest", "localhost:5000/app:latest"},
+		{"nginx:1.25@" + testDigest, "docker.io/library/nginx:1.25@" + testDigest, "nginx:1.25@" + testDigest},
+		// what can't be parsed comes back as it was
+		{"Nginx", "Nginx", "Nginx"},
+	}
+	for _, test := range cases {
+		if normalized := Normalize(test.image); normalized != test.normalized {
+			t.Errorf("Normalize(%q) = %q, want %q", test.image, normalized, test.normalized)
+		}
+		if familiar := Familiar(test.image); familiar != test.familiar {
+			t.Errorf("Familiar(%q) = %q, want %q", test.image, familiar, test.familiar)
+		}
+	}
+}
+
+func TestMirrorsCanonical(t *testing.T) {
+	mirrors := Mirrors{
+		{Prefix: "harbor.internal/mirror", Canonical: "docker.io"},
+		{Prefix: "harbor.internal/mirror/ghcr", Canonical: "ghcr.io/"},
+		{Prefix: "mirror.gcr.io/", Canonical: "docker.io"},
+		{Prefix: "registry.local:5000/k8s", Canonical: "registry.k8s.io"},
+	}
+	cases := []struct {
+		image, want string
+	}{
+		{"harbor.internal/mirror/nginx:1.25", "docker.io/library/nginx:1.25"},
+		{"harbor.internal/mirror/bitnami/redis", "docker.io/bitnami/redis:latest"},
+		// the longest prefix wins
+		{"harbor.internal/mirror/ghcr/org/app:v2", "ghcr.io/org/app:v2"},
+		{"mirror.gcr.io/library/nginx@" + testDigest, "docker.io/library/nginx@" + testDigest},
+		{"registry.local:5000/k8s/pause:3.9", "registry.k8s.io/pause:3.9"},
+		// only whole path components match
+		{"harbor.internal/mirrors/nginx:1.25", "harbor.internal/mirrors/nginx:1.25"},
+		{"nginx:1.25", "docker.io/library/nginx:1.25"},
+	}
+	for _, test := range cases {
+		ref, err := Parse(test.image)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.image, err)
+		}
+		if canonical := mirrors.Canonical(ref).String(); canonical != test.want {
+			t.Errorf("Canonical(%q) = %q, want %q", test.image, canonical, test.want)
+		}
+	}
+}
+
+func TestMirrorValidate(t *testing.T) {
+	cases := []struct {
+		mirror Mirror
+		valid  bool
+	}{
+		{Mirror{Prefix: "harbor.internal/mirror", Canonical: "docker.io"}, true},
+		{Mirror{Prefix: "localhost:5000", Canonical: "ghcr.io/org/"}, true},
+		{Mirror{Prefix: "", Canonical: "docker.io"}, false},
+		{Mirror{Prefix: "harbor.internal/Mirror", Canonical: "docker.io"}, false},
+	}
+	for _, test := range cases {
+		if err := test.mirror.Validate(); (err == nil) != test.valid {
+			t.Errorf("%+v.Validate() = %v, want valid %t", test.mirror, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Gr1nx-bitibt/kubetroller/imageref"
+)
+
+/*
+	Air-gapped clusters pull harbor.internal/mirror/nginx:1.25 where the cloud ones pull
+	docker.io/library/nginx:1.25, which is the same image. The images section of the config
+	file says which registries are mirrors of which, and everything that compares images across
+	clusters (the table colours, digest conflicts) looks at the canonical image instead:
+
+	images:
+	  mirrors:
+	    - prefix: harbor.internal/mirror
+	      canonical: docker.io
+	    - prefix: harbor.internal/gcr
+	      canonical: gcr.io
+	  # also treat two images as the same version when their pods run the same digest,
+	  # whatever they're called
+	  matchDigests: true
+
+	Like serviceIdentity this is read once at startup.
+*/
+
+type ImagesConfig struct {
+	Mirrors      imageref.Mirrors `json:"mirrors,omitempty"`
+	MatchDigests bool             `json:"matchDigests,omitempty"`
+	// how versions are ordered, for every service and then per service (see ordering.go)
+	Ordering        string            `json:"ordering,omitempty"`
+	ServiceOrdering map[string]string `json:"serviceOrdering,omitempty"`
+}
+
+var imageSettings ImagesConfig
+
+func validateImagesConfig(images *ImagesConfig) error {
+	var problems []string
+	for index, mirror := range images.Mirrors {
+		if err := mirror.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("images.mirrors[%d]: %s", index, err.Error()))
+		}
+	}
+	if images.Ordering != "" {
+		if err := validateOrdering(images.Ordering); err != nil {
+			problems = append(problems, fmt.Sprintf("images.ordering: %s", err.Error()))
+		}
+	}
+	for service, ordering := range images.ServiceOrdering {
+		if err := validateOrdering(ordering); err != nil {
+			problems = append(problems, fmt.Sprintf("images.serviceOrdering[%s]: %s", service, err.Error()))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// canonicalReference is the container's image with the mirrors taken out, nil if it couldn't be parsed
+func (container ContainerInfo) canonicalReference() *imageref.Reference {
+	if container.Reference == nil {
+		return nil
+	}
+	canonical := imageSettings.Mirrors.Canonical(*container.Reference)
+	return &canonical
+}
+
+// versionKey is what decides whether two containers run the same version. With matchDigests
+// a single running digest beats whatever the image is called.
+func (container ContainerInfo) versionKey() string {
+	if imageSettings.MatchDigests && len(container.Digests) == 1 {
+		return container.Digests[0]
+	}
+	return container.normalizedImage()
+}
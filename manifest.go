@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/Gr1nx-bitibt/kubetroller/imageref"
+)
+
+/*
+	The release manifest is what should be running, kubetroller checks it against what is.
+	It's its own file (manifest: ./release.yaml in the config file, or -manifest) so the
+	release process can write it without touching the cluster list:
+
+	services:
+	  default/api:
+	    # every cluster, unless something more specific below says otherwise
+	    image: ghcr.io/acme/api:1.4.0
+	    # clusters by their labels (if more than one matches, the first in alphabetical order wins)
+	    selectors:
+	      env=staging: ghcr.io/acme/api:1.5.0
+	    # and single clusters, which win over everything
+	    clusters:
+	      dev: ghcr.io/acme/api:1.6.0-rc.1
+
+	Services are keyed like everywhere else (see serviceKey). The expected image is compared
+	with the container of the service that runs that image (mirrors are taken into account,
+	see images.go), so sidecars don't get in the way. A tag has to match, a digest has to match
+	the image or what the pods run.
+
+	GET /compliance says for each cluster and service whether it's a match, a mismatch, missing
+	(expected but not running) or unexpected (running in a cluster the manifest has expectations
+	for, but not for this service). The workloads in the member clusters also get Events when
+	they stop matching (VersionMismatch) and when they match again (VersionCompliant), which
+	needs permission to create events there.
+
+	The file is checked for changes as often as the config file is and every workload gets
+	checked again when it does.
+*/
+
+const (
+	complianceMatch      = "match"
+	complianceMismatch   = "mismatch"
+	complianceMissing    = "missing"
+	complianceUnexpected = "unexpected"
+)
+
+type ReleaseManifest struct {
+	Services map[string]ServiceExpectation `json:"services"`
+}
+
+type ServiceExpectation struct {
+	Image     string            `json:"image,omitempty"`
+	Selectors map[string]string `json:"selectors,omitempty"`
+	Clusters  map[string]string `json:"clusters,omitempty"`
+}
+
+// manifestStore is the manifest that's loaded right now, nil if there isn't one
+type manifestStore struct {
+	manifest *ReleaseManifest
+	path     string
+	mutx     sync.RWMutex
+}
+
+var releaseManifest = &manifestStore{}
+
+func (store *manifestStore) get() (*ReleaseManifest, string) {
+	store.mutx.RLock()
+	defer store.mutx.RUnlock()
+	return store.manifest, store.path
+}
+
+func (store *manifestStore) set(manifest *ReleaseManifest, path string) {
+	store.mutx.Lock()
+	defer store.mutx.Unlock()
+	store.manifest, store.path = manifest, path
+}
+
+func loadManifest(path string) (*ReleaseManifest, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading release manifest: %w", err)
+	}
+	var manifest ReleaseManifest
+	if err := yaml.UnmarshalStrict(bytes, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing release manifest %s: %w", path, err)
+	}
+	if err := validateManifest(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid release manifest %s:\n%w", path, err)
+	}
+	return &manifest, nil
+}
+
+func validateManifest(manifest *ReleaseManifest) error {
+	var problems []string
+	checkImage := func(where, image string) {
+		if _, err := imageref.Parse(image); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", where, err.Error()))
+		}
+	}
+	for service, expectation := range manifest.Services {
+		if expectation.Image == "" && len(expectation.Selectors) == 0 && len(expectation.Clusters) == 0 {
+			problems = append(problems, fmt.Sprintf("services[%s]: needs an image, selectors or clusters", service))
+		}
+		if expectation.Image != "" {
+			checkImage(fmt.Sprintf("services[%s].image", service), expectation.Image)
+		}
+		for selector, image := range expectation.Selectors {
+			if _, err := labels.Parse(selector); err != nil {
+				problems = append(problems, fmt.Sprintf("services[%s].selectors[%s]: %s", service, selector, err.Error()))
+			}
+			checkImage(fmt.Sprintf("services[%s].selectors[%s]", service, selector), image)
+		}
+		for cluster, image := range expectation.Clusters {
+			checkImage(fmt.Sprintf("services[%s].clusters[%s]", service, cluster), image)
+		}
+	}
+	sort.Strings(problems)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// expected is the image the manifest wants the service to run in the cluster, if it says anything
+func (manifest *ReleaseManifest) expected(service, cluster string, clusterLabels map[string]string) (string, bool) {
+	expectation, exists := manifest.Services[service]
+	if !exists {
+		return "", false
+	}
+	if image, exists := expectation.Clusters[cluster]; exists {
+		return image, true
+	}
+	selectors := make([]string, 0, len(expectation.Selectors))
+	for selector := range expectation.Selectors {
+		selectors = append(selectors, selector)
+	}
+	sort.Strings(selectors)
+	for _, selector := range selectors {
+		if parsed, err := labels.Parse(selector); err == nil && parsed.Matches(labels.Set(clusterLabels)) {
+			return expectation.Selectors[selector], true
+		}
+	}
+	return expectation.Image, expectation.Image != ""
+}
+
+// covers says whether the manifest expects anything at all in the cluster, services running in
+// clusters it doesn't cover aren't unexpected
+func (manifest *ReleaseManifest) covers(cluster string, clusterLabels map[string]string) bool {
+	for service := range manifest.Services {
+		if _, expected := manifest.expected(service, cluster, clusterLabels); expected {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContainers compares the expected image with the container running that image and
+// returns the status and what's running
+func checkContainers(expected string, containers []ContainerInfo) (string, []string) {
+	var running []string
+	for _, container := range containers {
+		running = append(running, container.displayImage())
+	}
+	ref, err := imageref.Parse(expected)
+	if err != nil {
+		return complianceMismatch, running
+	}
+	ref = imageSettings.Mirrors.Canonical(ref)
+
+	status := complianceMismatch
+	for _, container := range containers {
+		actual := container.canonicalReference()
+		if actual == nil || actual.Name() != ref.Name() {
+			continue
+		}
+		if ref.Tag != "" && actual.Tag != ref.Tag {
+			return complianceMismatch, running
+		}
+		if ref.Digest != "" && actual.Digest != ref.Digest && !slices.Contains(container.Digests, ref.Digest) {
+			return complianceMismatch, running
+		}
+		status = complianceMatch
+	}
+	return status, running
+}
+
+type ComplianceReport struct {
+	Manifest string              `json:"manifest"`
+	Summary  map[string]int      `json:"summary"`
+	Results  []ServiceCompliance `json:"results"`
+}
+
+type ServiceCompliance struct {
+	Cluster  string   `json:"cluster"`
+	Service  string   `json:"service"`
+	Status   string   `json:"status"`
+	Expected string   `json:"expected,omitempty"`
+	Running  []string `json:"running,omitempty"`
+}
+
+func getCompliance(writer http.ResponseWriter, req *http.Request) {
+	manifest, path := releaseManifest.get()
+	if manifest == nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: "no release manifest, set manifest in the config file or use -manifest"})
+		return
+	}
+	report := complianceReport(manifest, servingSnapshots(Controllers.snapshot()))
+	report.Manifest = path
+	writeJSON(writer, http.StatusOK, report)
+}
+
+func complianceReport(manifest *ReleaseManifest, snapshots []ClusterSnapshot) ComplianceReport {
+	report := ComplianceReport{
+		Summary: map[string]int{complianceMatch: 0, complianceMismatch: 0, complianceMissing: 0, complianceUnexpected: 0},
+		Results: []ServiceCompliance{},
+	}
+
+	services := serviceKeys(snapshots)
+	for service := range manifest.Services {
+		services = appendMissing(services, service)
+	}
+	sort.Strings(services)
+
+	for _, snapshot := range snapshots {
+		covered := manifest.covers(snapshot.ClusterName, snapshot.Labels)
+		for _, service := range services {
+			containers := serviceContainers(snapshot, service)
+			expected, isExpected := manifest.expected(service, snapshot.ClusterName, snapshot.Labels)
+			result := ServiceCompliance{Cluster: snapshot.ClusterName, Service: service, Expected: expected}
+			switch {
+			case isExpected && len(containers) == 0:
+				result.Status = complianceMissing
+			case isExpected:
+				result.Status, result.Running = checkContainers(expected, containers)
+			case covered && len(containers) > 0:
+				result.Status = complianceUnexpected
+				for _, container := range containers {
+					result.Running = append(result.Running, container.displayImage())
+				}
+			default:
+				continue
+			}
+			report.Summary[result.Status]++
+			report.Results = append(report.Results, result)
+		}
+	}
+	return report
+}
+
+// reportCompliance checks a workload that was just synced against the manifest and puts an
+// Event on it when that changed since the last time
+func (c *Controller) reportCompliance(ctx context.Context, key WorkloadKey, obj interface{}, containers []ContainerInfo) {
+	manifest, _ := releaseManifest.get()
+	object, ok := obj.(runtime.Object)
+	if manifest == nil || !ok {
+		return
+	}
+	expected, isExpected := manifest.expected(serviceKey(key), c.clusterName, c.config.Labels)
+	if !isExpected {
+		c.forgetCompliance(key)
+		return
+	}
+	status, running := checkContainers(expected, containers)
+	// the images are part of it so a workload that goes from one wrong version to another gets told again
+	state := status + " " + strings.Join(running, ",")
+
+	c.complianceMutx.Lock()
+	previous, seen := c.compliance[key]
+	c.compliance[key] = state
+	c.complianceMutx.Unlock()
+	if seen && previous == state {
+		return
+	}
+
+	logger := klog.FromContext(ctx)
+	switch {
+	case status == complianceMismatch:
+		logger.Info("Workload doesn't match the release manifest", "key", key, "controller", c.clusterName, "expected", expected, "running", running)
+		c.recorder.Eventf(object, corev1.EventTypeWarning, "VersionMismatch", "Running %s, the release manifest expects %s", strings.Join(running, ", "), expected)
+	case seen && strings.HasPrefix(previous, complianceMismatch):
+		c.recorder.Eventf(object, corev1.EventTypeNormal, "VersionCompliant", "Running %s as the release manifest expects", expected)
+	}
+}
+
+func (c *Controller) forgetCompliance(key WorkloadKey) {
+	c.complianceMutx.Lock()
+	defer c.complianceMutx.Unlock()
+	delete(c.compliance, key)
+}
+
+// requeueAll syncs every workload again, for when something they're checked against changes
+func (c *Controller) requeueAll() {
+	for key := range c.deployments.snapshot() {
+		c.workqueue.Add(key)
+	}
+}
+
+// watchManifest loads the manifest again when the file changes and has every cluster check
+// its workloads against the new one
+func watchManifest(ctx context.Context, path string, interval time.Duration) {
+	logger := klog.FromContext(ctx)
+	lastHash := hashFiles([]string{path})
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		hash := hashFiles([]string{path})
+		if hash == lastHash {
+			return
+		}
+		lastHash = hash
+		manifest, err := loadManifest(path)
+		if err != nil {
+			logger.Error(err, "Release manifest changed but couldn't be loaded, keeping the current one")
+			return
+		}
+		logger.Info("Release manifest changed, checking every workload again", "path", path)
+		releaseManifest.set(manifest, path)
+		for _, controller := range Controllers.controllers() {
+			controller.requeueAll()
+		}
+	}, interval)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/util/workqueue"
+)
+
+/*
+	GET /metrics in the Prometheus format:
+
+	image_info{cluster,namespace,kind,workload,container,image}    1 for every container running in
+	                                                                every cluster
+	kubetroller_service_versions{service}                          how many versions of the service
+	                                                                run across the clusters, 1 is in sync
+	kubetroller_service_drift{service,cluster,status}              1 for each cluster's drift status
+	                                                                (see drift.go), only with a reference
+	kubetroller_cluster_synced{cluster,source}                     1 once the cluster has caught up
+	kubetroller_cluster_last_event_timestamp_seconds{cluster}      when the cluster last sent a change
+	kubetroller_workqueue_*{name}                                  depth, adds, latency, work duration
+	                                                                and retries of each cluster's
+	                                                                workqueue, name is the cluster
+
+	Everything except the workqueues is worked out from the inventory when it's scraped, so it
+	can't get out of step with what the API says. Alert on kubetroller_service_versions > 1, or on
+	kubetroller_cluster_synced == 0.
+*/
+
+const scrapeRegistryTimeout = 2 * time.Second
+
+var (
+	imageInfoDesc = prometheus.NewDesc("image_info",
+		"The image a container of a workload runs, always 1.",
+		[]string{"cluster", "namespace", "kind", "workload", "container", "image"}, nil)
+	serviceVersionsDesc = prometheus.NewDesc("kubetroller_service_versions",
+		"How many different versions of the service run across the clusters.",
+		[]string{"service"}, nil)
+	serviceDriftDesc = prometheus.NewDesc("kubetroller_service_drift",
+		"The service's drift from the reference cluster in each cluster, 1 for the status it has.",
+		[]string{"service", "cluster", "status"}, nil)
+	clusterSyncedDesc = prometheus.NewDesc("kubetroller_cluster_synced",
+		"Whether the cluster has sent everything it had when it started.",
+		[]string{"cluster", "source"}, nil)
+	clusterLastEventDesc = prometheus.NewDesc("kubetroller_cluster_last_event_timestamp_seconds",
+		"When the cluster last sent a change, as a unix timestamp.",
+		[]string{"cluster"}, nil)
+)
+
+var (
+	workqueueMetrics = newWorkqueueMetricsProvider()
+	metricsRegistry  = newMetricsRegistry()
+)
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		fleetCollector{},
+	)
+	workqueueMetrics.register(registry)
+	return registry
+}
+
+func registerMetricsHandler(mux *http.ServeMux) {
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// fleetCollector reads the inventory on every scrape
+type fleetCollector struct{}
+
+func (fleetCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{imageInfoDesc, serviceVersionsDesc, serviceDriftDesc, clusterSyncedDesc, clusterLastEventDesc} {
+		descs <- desc
+	}
+}
+
+func (fleetCollector) Collect(metrics chan<- prometheus.Metric) {
+	snapshots := servingSnapshots(Controllers.snapshot())
+	for _, snapshot := range snapshots {
+		for key, workload := range snapshot.Workloads {
+			// the same labels twice would fail the whole scrape, and a git source can have
+			// manifests that Kubernetes would reject
+			seen := make(map[string]bool)
+			for _, container := range workload.Containers {
+				if seen[container.Name] {
+					continue
+				}
+				seen[container.Name] = true
+				metrics <- prometheus.MustNewConstMetric(imageInfoDesc, prometheus.GaugeValue, 1,
+					snapshot.ClusterName, key.Namespace, key.Kind, key.Name, container.Name, container.Image)
+			}
+		}
+	}
+
+	for _, service := range serviceKeys(snapshots) {
+		versions := make(map[string]bool)
+		for _, snapshot := range snapshots {
+			if containers := serviceContainers(snapshot, service); len(containers) > 0 {
+				versions[versionKeys(containers)] = true
+			}
+		}
+		metrics <- prometheus.MustNewConstMetric(serviceVersionsDesc, prometheus.GaugeValue, float64(len(versions)), service)
+	}
+
+	if driftSettings.Reference != "" || driftSettings.ReferenceSelector != "" {
+		// a scrape doesn't wait long for the registry, what it doesn't get to is looked up for the next one
+		ctx, cancel := context.WithTimeout(context.Background(), scrapeRegistryTimeout)
+		defer cancel()
+		// no reference running right now means there's nothing to report, not an error
+		if report, err := driftReport(ctx, driftSettings, snapshots); err == nil {
+			for _, service := range report.Services {
+				for _, cluster := range service.Clusters {
+					metrics <- prometheus.MustNewConstMetric(serviceDriftDesc, prometheus.GaugeValue, 1, service.Service, cluster.Cluster, cluster.Status)
+				}
+			}
+		}
+	}
+
+	for _, status := range Controllers.statuses() {
+		synced := 0.0
+		if status.Synced {
+			synced = 1
+		}
+		metrics <- prometheus.MustNewConstMetric(clusterSyncedDesc, prometheus.GaugeValue, synced, status.Name, status.Source)
+		if status.LastEvent != nil {
+			metrics <- prometheus.MustNewConstMetric(clusterLastEventDesc, prometheus.GaugeValue, float64(status.LastEvent.UnixNano())/1e9, status.Name)
+		}
+	}
+}
+
+// workqueueMetricsProvider is handed to every controller's workqueue (see NewController), the
+// queues are named after their cluster
+type workqueueMetricsProvider struct {
+	depth          *prometheus.GaugeVec
+	adds           *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	workDuration   *prometheus.HistogramVec
+	unfinished     *prometheus.GaugeVec
+	longestRunning *prometheus.GaugeVec
+	retries        *prometheus.CounterVec
+}
+
+func newWorkqueueMetricsProvider() *workqueueMetricsProvider {
+	labels := []string{"name"}
+	buckets := prometheus.ExponentialBuckets(10e-9, 10, 12)
+	return &workqueueMetricsProvider{
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "kubetroller", Subsystem: "workqueue", Name: "depth",
+			Help: "How many workloads are waiting in the workqueue.",
+		}, labels),
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "kubetroller", Subsystem: "workqueue", Name: "adds_total",
+			Help: "How many workloads have been added to the workqueue.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "kubetroller", Subsystem: "workqueue", Name: "queue_duration_seconds",
+			Help: "How long workloads wait in the workqueue before they're synced.", Buckets: buckets,
+		}, labels),
+		workDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "kubetroller", Subsystem: "workqueue", Name: "work_duration_seconds",
+			Help: "How long syncing a workload takes.", Buckets: buckets,
+		}, labels),
+		unfinished: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "kubetroller", Subsystem: "workqueue", Name: "unfinished_work_seconds",
+			Help: "How long the syncs that are still running have been running for, added up.",
+		}, labels),
+		longestRunning: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "kubetroller", Subsystem: "workqueue", Name: "longest_running_processor_seconds",
+			Help: "How long the longest running sync has been running for.",
+		}, labels),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "kubetroller", Subsystem: "workqueue", Name: "retries_total",
+			Help: "How many workloads have been requeued after a sync failed.",
+		}, labels),
+	}
+}
+
+func (provider *workqueueMetricsProvider) register(registry *prometheus.Registry) {
+	registry.MustRegister(provider.depth, provider.adds, provider.latency, provider.workDuration,
+		provider.unfinished, provider.longestRunning, provider.retries)
+}
+
+// forget drops a stopped cluster's series so it doesn't look stuck forever
+func (provider *workqueueMetricsProvider) forget(name string) {
+	provider.depth.DeleteLabelValues(name)
+	provider.adds.DeleteLabelValues(name)
+	provider.latency.DeleteLabelValues(name)
+	provider.workDuration.DeleteLabelValues(name)
+	provider.unfinished.DeleteLabelValues(name)
+	provider.longestRunning.DeleteLabelValues(name)
+	provider.retries.DeleteLabelValues(name)
+}
+
+func (provider *workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return provider.depth.WithLabelValues(name)
+}
+
+func (provider *workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return provider.adds.WithLabelValues(name)
+}
+
+func (provider *workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return provider.latency.WithLabelValues(name)
+}
+
+func (provider *workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return provider.workDuration.WithLabelValues(name)
+}
+
+func (provider *workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return provider.unfinished.WithLabelValues(name)
+}
+
+func (provider *workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return provider.longestRunning.WithLabelValues(name)
+}
+
+func (provider *workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return provider.retries.WithLabelValues(name)
+}
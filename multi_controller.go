@@ -4,52 +4,91 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/klog/v2"
 
 	// v1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	kubeinformers "k8s.io/client-go/informers"
-	deployinformers "k8s.io/client-go/informers/apps/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
-)
 
-type ClusterConfig struct {
-	clusterName string
-	configPath  string
-}
+	"github.com/Gr1nx-bitibt/kubetroller/imageref"
+)
 
 type Controller struct {
 	clusterName        string
-	configPath         string
+	config             ClusterConfig
 	client             kubernetes.Interface
-	kInformerFactory   kubeinformers.SharedInformerFactory
-	deploymentInformer deployinformers.DeploymentInformer
-	workqueue          workqueue.TypedRateLimitingInterface[cache.ObjectName]
-	recorder           record.EventRecorder
-	deployments        map[string]DeployConfigs
+	dclient            dynamic.Interface
+	kInformerFactories []kubeinformers.SharedInformerFactory
+	dInformerFactories []dynamicinformer.DynamicSharedInformerFactory
+	// every kind this cluster tracks, the built in ones and its custom resources
+	kinds map[string]workloadKind
+	// one informer per kind per namespace factory
+	informers map[string][]cache.SharedIndexInformer
+	// the pods of the workloads and what's in between (ReplicaSets and Jobs), see pods.go
+	podInformers   []cache.SharedIndexInformer
+	ownerInformers map[string][]cache.SharedIndexInformer
+	// owner reference kind to the kind we track it as
+	ownerKinds       map[string]string
+	workqueue        workqueue.TypedRateLimitingInterface[WorkloadKey]
+	eventBroadcaster record.EventBroadcaster
+	recorder         record.EventRecorder
+	// keyed by kind and namespace/name, two deployments with the same name in different namespaces are different deployments
+	deployments *WorkloadStore
+	// what each workload looked like against the release manifest last time, see manifest.go
+	compliance     map[WorkloadKey]string
+	complianceMutx sync.Mutex
 }
 
 type DeployConfigs struct {
-	Cluster   string `json:"cluster"`
-	Namespace string `json:"namespace"`
-	Image     string `json:"image"`
+	Cluster    string          `json:"cluster"`
+	Kind       string          `json:"kind"`
+	Namespace  string          `json:"namespace"`
+	Name       string          `json:"name"`
+	Containers []ContainerInfo `json:"containers"`
+}
+
+// ContainerInfo is one container of a workload's pod template. Init and ephemeral containers
+// are in the same list with a flag so the order they run in doesn't get lost.
+type ContainerInfo struct {
+	Name string `json:"name"`
+	// the image as it's written in the pod template, Reference is the parsed and normalized
+	// version of it (nil if it couldn't be parsed) and what should be used to compare images
+	Image     string              `json:"image"`
+	Reference *imageref.Reference `json:"reference,omitempty"`
+	Init      bool                `json:"init,omitempty"`
+	Ephemeral bool                `json:"ephemeral,omitempty"`
+	// the image digests the workload's pods are actually running for this container
+	Digests []string `json:"digests,omitempty"`
+	// the pods of the workload don't all run the same digest
+	MixedDigests bool `json:"mixedDigests,omitempty"`
+	// another cluster runs the same image with a different digest, only set in the API
+	DigestConflict bool `json:"digestConflict,omitempty"`
+	// the last change went to an older version (see ordering.go), and what it was before
+	Downgraded    bool   `json:"downgraded,omitempty"`
+	PreviousImage string `json:"previousImage,omitempty"`
+	// the image this is a mirror of (see images.go), only set in the API and only when it's pulled through a mirror
+	Canonical string `json:"canonical,omitempty"`
 }
 
 /*
@@ -74,90 +113,144 @@ const (
 )
 
 var (
-	Controllers = make(map[string]*Controller)
+	Controllers = newClusterManager()
 )
 
-// I just want to store keys and no values
-// getting rid of this for now so we don't have to worry about concurrent writes
-var serviceNames = ServiceNames{services: make(map[string]int)}
-
 func main() {
 	ctx := signals.SetupSignalHandler()
-	var clusterString string
-	flag.StringVar(&clusterString, "clusters", "EMPTY", "specify the names of the clusters and their kubeconfig file in a colon-pair comma seperated format, e.g. -clusters='name1:config,name2:config' ")
+	var clusterString, configFile, includeContexts, excludeContexts, identity, manifestFile, listenAddress, probeAddress string
+	var discoverContexts, hubMode bool
+	var configPollInterval time.Duration
+	flag.StringVar(&configFile, "config", "", "path to a YAML or JSON file listing the clusters to watch (see config.example.yaml)")
+	flag.StringVar(&clusterString, "clusters", "", "deprecated, use -config. The names of the clusters and their kubeconfig file in a colon-pair comma seperated format, e.g. -clusters='name1:config,name2:config' ")
+	flag.BoolVar(&discoverContexts, "discover-contexts", false, "watch every context in $KUBECONFIG (or ~/.kube/config) as its own cluster")
+	flag.StringVar(&includeContexts, "include-contexts", "", "with -discover-contexts, comma separated glob patterns of the context names to watch, e.g. 'prod-*,staging-*'")
+	flag.StringVar(&excludeContexts, "exclude-contexts", "", "with -discover-contexts, comma separated glob patterns of the context names to skip")
+	flag.DurationVar(&configPollInterval, "config-poll-interval", 10*time.Second, "how often to check the config file and kubeconfigs for changes, 0 turns it off")
+	flag.StringVar(&identity, "service-identity", "", "what makes deployments in different clusters the same service: 'namespace' (namespace and name match, the default) or 'name' (just the name matches). Overrides serviceIdentity in the config file")
+	flag.StringVar(&manifestFile, "manifest", "", "path to a release manifest of the images each service should run (see manifest.go). Overrides manifest in the config file")
+	flag.BoolVar(&hubMode, "hub", false, "run inside a hub cluster and watch the member clusters registered as labelled Secrets (see hub.go)")
+	flag.StringVar(&listenAddress, "listen", "localhost:8082", "the address the API is served on. The admin endpoints have no auth, so think twice before opening it up")
+	flag.StringVar(&probeAddress, "probe-listen", ":8083", "the address /healthz, /readyz and /metrics are also served on for probes and Prometheus, empty turns it off")
 	flag.Parse()
 
+	var hub *HubConfig
+	if hubMode {
+		hub = &HubConfig{}
+	}
+
+	var discovery *DiscoveryConfig
+	if discoverContexts {
+		discovery = &DiscoveryConfig{Include: splitList(includeContexts), Exclude: splitList(excludeContexts)}
+	} else if includeContexts != "" || excludeContexts != "" {
+		fmt.Println("-include-contexts and -exclude-contexts only work together with -discover-contexts")
+		os.Exit(1)
+	}
+
+	loadStaticConfig := func() (*FileConfig, error) {
+		return loadConfig(configFile, clusterString, discovery, hub)
+	}
+	fileConfig, err := loadStaticConfig()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	// this is only read once, a service that changed key halfway through would look like two
+	if identity == "" {
+		identity = fileConfig.ServiceIdentity
+	}
+	if identity != "" {
+		if err := validateServiceIdentity(identity); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		serviceIdentity = identity
+	}
+	// same for the mirrors, they're only read once
+	if fileConfig.Images != nil {
+		imageSettings = *fileConfig.Images
+	}
+	if fileConfig.Drift != nil {
+		driftSettings = *fileConfig.Drift
+	}
+	if fileConfig.Promotion != nil {
+		promotionSettings = *fileConfig.Promotion
+	}
+	// the manifest is loaded before the clusters start so their first syncs get checked against it
+	if manifestFile == "" {
+		manifestFile = fileConfig.Manifest
+	}
+	if manifestFile != "" {
+		manifest, err := loadManifest(manifestFile)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		releaseManifest.set(manifest, manifestFile)
+	}
+	// and the history store before them too, so their first syncs get compared with what ran last time
+	if fileConfig.History != nil {
+		db, err := openHistoryDB(*fileConfig.History)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		defer db.close()
+		if err := versionHistory.useStore(db); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		go versionHistory.runCompaction(ctx)
+	}
+
 	// so now that we can get all the kubeconfig files, we have to build each client seperately...
 	// idk if trying to build the same client twice will break the program... guess we'll see!
-	// controllers := make(map[string]*Controller)
-	clusterConfigs := getClustersFromFlag(clusterString)
-	for index, clusterConfig := range clusterConfigs {
-		config, err := clientcmd.BuildConfigFromFlags("", clusterConfig.configPath)
-		if err != nil {
-			fmt.Printf("Something went wrong with cluster config #%d! Error: %s\n", index, err.Error())
+	// (a cluster that can't be reached doesn't stop the others, it's retried in the background)
+	for _, clusterConfig := range fileConfig.Clusters {
+		if err := Controllers.start(ctx, clusterConfig, sourceConfig); err != nil {
+			fmt.Printf("Something went wrong with cluster %s! Error: %s\n", clusterConfig.Name, err.Error())
 			os.Exit(2)
 		}
-
-		kclient, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			fmt.Println("Trouble building client! Error: ", err.Error())
-			os.Exit(3)
+	}
+	for _, gitConfig := range fileConfig.Git {
+		if err := Controllers.startGit(ctx, gitConfig); err != nil {
+			fmt.Printf("Something went wrong with git source %s! Error: %s\n", gitConfig.Name, err.Error())
+			os.Exit(2)
 		}
+	}
+	Controllers.doneStartingUp()
 
-		Controllers[clusterConfig.clusterName] = NewController(ctx, kclient, clusterConfig)
+	if configPollInterval > 0 && (configFile != "" || clusterString != "" || discovery != nil) {
+		watcher := newConfigWatcher(loadStaticConfig, configFile, fileConfig, configPollInterval)
+		go watcher.Run(ctx)
+	}
+	if configPollInterval > 0 && manifestFile != "" {
+		go watchManifest(ctx, manifestFile, configPollInterval)
 	}
 
-	var wg sync.WaitGroup
-	for controllerName, controller := range Controllers {
-		msg := fmt.Sprintf("Invoking controller %s", controllerName)
-		klog.InfoS(msg)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := controller.Run(ctx); err != nil {
-				klog.FlushAndExit(klog.ExitFlushTimeout, 1)
-			}
-		}()
+	if fileConfig.Hub != nil {
+		go runHub(ctx, fileConfig.Hub)
 	}
 
+	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		serve()
+		serve(ctx, listenAddress, probeAddress)
 	}()
 
 	// time.Sleep(time.Second)
 	// wg.Add(1)
 	// go func() {
 	// 	defer wg.Done()
-	// 	for formatData(ctx, &Controllers, &serviceNames) {
+	// 	for formatData(ctx, Controllers.snapshot()) {
 	// 		time.Sleep(time.Second * 10)
 	// 	}
 	// }()
 
 	wg.Wait()
-}
-
-func getClustersFromFlag(clusterString string) []ClusterConfig {
-	var clusterConfigs []ClusterConfig
-	var clusterNames = make(map[string]interface{})
-
-	for _, clusterPair := range strings.Split(clusterString, ",") {
-		pair := strings.Split(clusterPair, ":")
-		if _, exists := clusterNames[pair[0]]; exists {
-			fmt.Println("Cluster names must be unique. Please respecify the names of the clusters to avoid this conflict (names are case sensitive).")
-			os.Exit(1)
-		} else {
-			clusterNames[pair[0]] = nil
-		}
-
-		clusterConfigs = append(clusterConfigs, ClusterConfig{
-			clusterName: pair[0],
-			configPath:  pair[1],
-		})
-	}
-
-	return clusterConfigs
+	Controllers.wait()
 }
 
 /*
@@ -172,6 +265,7 @@ func getClustersFromFlag(clusterString string) []ClusterConfig {
 func NewController(
 	ctx context.Context,
 	clientset kubernetes.Interface,
+	dclient dynamic.Interface,
 	config ClusterConfig) *Controller {
 	logger := klog.FromContext(ctx)
 	logger.V(4).Info("Creating event broadcaster")
@@ -180,84 +274,194 @@ func NewController(
 	eventBroadcaster.StartStructuredLogging(0)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
 
-	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: config.clusterName})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: config.Name})
 	ratelimiter := workqueue.NewTypedMaxOfRateLimiter(
-		workqueue.NewTypedItemExponentialFailureRateLimiter[cache.ObjectName](5*time.Millisecond, 1000*time.Second),
-		&workqueue.TypedBucketRateLimiter[cache.ObjectName]{Limiter: rate.NewLimiter(rate.Limit(50), 300)},
+		workqueue.NewTypedItemExponentialFailureRateLimiter[WorkloadKey](5*time.Millisecond, 1000*time.Second),
+		&workqueue.TypedBucketRateLimiter[WorkloadKey]{Limiter: rate.NewLimiter(rate.Limit(50), 300)},
 	)
-	informerFactory := kubeinformers.NewSharedInformerFactory(clientset, time.Second*10)
+
+	// named after the cluster for its metrics, see metrics.go
+	queue := workqueue.NewTypedRateLimitingQueueWithConfig(ratelimiter, workqueue.TypedRateLimitingQueueConfig[WorkloadKey]{
+		Name:            config.Name,
+		MetricsProvider: workqueueMetrics,
+	})
 
 	controller := &Controller{
-		clusterName:        config.clusterName,
-		configPath:         config.configPath,
-		client:             clientset,
-		kInformerFactory:   informerFactory,
-		deploymentInformer: informerFactory.Apps().V1().Deployments(),
-		workqueue:          workqueue.NewTypedRateLimitingQueue(ratelimiter),
-		recorder:           recorder,
-		deployments:        make(map[string]DeployConfigs),
+		clusterName:      config.Name,
+		config:           config,
+		client:           clientset,
+		dclient:          dclient,
+		kinds:            make(map[string]workloadKind),
+		workqueue:        queue,
+		eventBroadcaster: eventBroadcaster,
+		recorder:         recorder,
+		informers:        make(map[string][]cache.SharedIndexInformer),
+		ownerInformers:   make(map[string][]cache.SharedIndexInformer),
+		ownerKinds:       make(map[string]string),
+		deployments:      newWorkloadStore(),
+		compliance:       make(map[WorkloadKey]string),
+	}
+
+	// an informer factory can only be scoped to one namespace (or all of them), so if the
+	// config lists namespaces we need a factory for each one
+	namespaces := config.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{v1.NamespaceAll}
+	}
+	for _, kindName := range config.kinds() {
+		controller.kinds[kindName], _ = findWorkloadKind(kindName)
+		controller.ownerKinds[kindName] = kindName
+	}
+	for _, resource := range config.CustomResources {
+		controller.kinds[resource.Kind] = resource.workloadKind()
+	}
+
+	for _, namespace := range namespaces {
+		informerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(clientset, config.resyncPeriod(), kubeinformers.WithNamespace(namespace))
+		controller.kInformerFactories = append(controller.kInformerFactories, informerFactory)
+		for _, kindName := range config.kinds() {
+			controller.informers[kindName] = append(controller.informers[kindName], controller.kinds[kindName].informer(informerFactory))
+		}
+		controller.watchPods(informerFactory, namespace)
+		// the custom resource informers get added in Run, once we know which ones the cluster has
+		if len(config.CustomResources) > 0 {
+			controller.dInformerFactories = append(controller.dInformerFactories,
+				dynamicinformer.NewFilteredDynamicSharedInformerFactory(dclient, config.resyncPeriod(), namespace, nil))
+		}
 	}
 
-	message := fmt.Sprintf("Setting up event handler for controller %s", config.clusterName)
+	message := fmt.Sprintf("Setting up event handler for controller %s", config.Name)
 	klog.Info(message)
 
-	// need to make the method for this thing -- HERE
-	controller.deploymentInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.checkToQueue,
-		// Ok, so we need this to change, because what happens when a deployment is updated by its name?
-		// that deployment which is the same as the oldobj is now a new key inside the map and consequently
-		// if the name isn't changed but something happens to the controller that isn't in deployment config
-		// we won't know. I think we can ignore that second part but we at least need to acknowledge the name
-		// by passing in both oldobj and newobj or checking there
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			oldObjRef, oldErr := cache.ObjectToName(oldObj)
-			if oldErr != nil {
-				utilruntime.HandleError(oldErr)
-			}
+	for kind, informers := range controller.informers {
+		for _, informer := range informers {
+			controller.addWorkloadHandlers(ctx, kind, informer)
+		}
+	}
+	controller.addPodHandlers()
 
-			newObjRef, newErr := cache.ObjectToName(newObj)
-			if newErr != nil {
-				utilruntime.HandleError(newErr)
-			}
+	return controller
+}
 
-			if oldObjRef.Name != newObjRef.Name {
-				delete(controller.deployments, newObjRef.Name)
-				controller.checkToQueue(newObj)
-			} else {
-				controller.checkToQueue(newObj)
+func (controller *Controller) addWorkloadHandlers(ctx context.Context, kind string, informer cache.SharedIndexInformer) {
+	logger := klog.FromContext(ctx)
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.checkToQueue(kind, obj)
+		},
+		// Workloads can't be renamed (or moved to another namespace), so an update is always about the same
+		// key. The informer also sends an update for every object on each resync, those have the same resource
+		// version and nothing to do.
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMeta, oldErr := meta.Accessor(oldObj)
+			newMeta, newErr := meta.Accessor(newObj)
+			if oldErr == nil && newErr == nil && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				return
 			}
+			controller.checkToQueue(kind, newObj)
 		},
 		DeleteFunc: func(obj interface{}) {
-			if objRef, err := cache.ObjectToName(obj); err != nil {
+			// obj can be a tombstone if we missed the delete while the watch was down
+			if objRef, err := cache.DeletionHandlingObjectToName(obj); err != nil {
 				utilruntime.HandleError(err)
 			} else {
-				serviceNames.decrement(ctx, objRef.Name)
-				delete(controller.deployments, objRef.Name)
-				logger.Info("delete callback invoked!", "key", objRef)
+				key := WorkloadKey{Kind: kind, Namespace: objRef.Namespace, Name: objRef.Name}
+				controller.forgetDeployment(ctx, key)
+				logger.Info("delete callback invoked!", "key", key)
 			}
 		},
 	})
-
-	return controller
 }
 
 // So next we have to start the informer factories which we can do in new controller
 // Then we have to actually make the method to start the controller
 
-func (c *Controller) Run(ctx context.Context) error {
+// the Controller is the Source for a live cluster (see source.go)
+func (c *Controller) Name() string {
+	return c.clusterName
+}
+
+func (c *Controller) Labels() map[string]string {
+	return c.config.Labels
+}
+
+func (c *Controller) Run(ctx context.Context, events chan<- InventoryEvent) error {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
 	logger := klog.FromContext(ctx)
+	// nothing has been added yet, the informers haven't started
+	c.deployments.notify = func(event InventoryEvent) {
+		sendEvent(ctx, events, event)
+	}
+
+	// checked from the start, looking for the custom resources waits for as long as the
+	// cluster can't be reached and it should show up as unavailable in the meantime
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		sendEvent(ctx, events, c.checkHealth(ctx))
+	}, healthInterval)
+	if err := c.watchCustomResources(ctx); err != nil {
+		return err
+	}
 
-	c.kInformerFactory.Start(ctx.Done())
+	// a failed list or watch is retried by the informer on its own, but the cluster isn't
+	// up to date until it works again
+	reportWatchErrors := func(reflector *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(reflector, err)
+		if err != io.EOF && err != io.ErrUnexpectedEOF && !apierrors.IsResourceExpired(err) && !apierrors.IsGone(err) {
+			sendEvent(ctx, events, InventoryEvent{Type: InventoryHealth, Err: err})
+		}
+	}
+	for _, informers := range c.informers {
+		for _, informer := range informers {
+			informer.SetWatchErrorHandler(reportWatchErrors)
+		}
+	}
+	for _, informers := range c.ownerInformers {
+		for _, informer := range informers {
+			informer.SetWatchErrorHandler(reportWatchErrors)
+		}
+	}
+	for _, informer := range c.podInformers {
+		informer.SetWatchErrorHandler(reportWatchErrors)
+	}
+	var synced []cache.InformerSynced
+	for _, informerFactory := range c.kInformerFactories {
+		informerFactory.Start(ctx.Done())
+	}
+	for _, informerFactory := range c.dInformerFactories {
+		informerFactory.Start(ctx.Done())
+	}
+	for _, informers := range c.informers {
+		for _, informer := range informers {
+			synced = append(synced, informer.HasSynced)
+		}
+	}
+	for _, informers := range c.ownerInformers {
+		for _, informer := range informers {
+			synced = append(synced, informer.HasSynced)
+		}
+	}
+	for _, informer := range c.podInformers {
+		synced = append(synced, informer.HasSynced)
+	}
 
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.deploymentInformer.Informer().HasSynced); !ok {
+	if ok := cache.WaitForCacheSync(ctx.Done(), synced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync! controller: %s", c.clusterName)
 	}
 
 	logger.Info("Starting controller, workers, and informer!", "controller", c.clusterName)
 
 	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	// every workload the informers listed is queued by now, it's caught up once they've been synced
+	go func() {
+		err := wait.PollUntilContextCancel(ctx, 100*time.Millisecond, true, func(ctx context.Context) (bool, error) {
+			return c.workqueue.Len() == 0, nil
+		})
+		if err == nil {
+			sendEvent(ctx, events, InventoryEvent{Type: InventorySynced})
+		}
+	}()
 
 	logger.Info("Started workers", "controller", c.clusterName)
 	<-ctx.Done()
@@ -266,6 +470,35 @@ func (c *Controller) Run(ctx context.Context) error {
 	return nil
 }
 
+// checkHealth asks the API server for its version and lists a pod, so both the connection
+// and the credentials get checked
+func (c *Controller) checkHealth(ctx context.Context) InventoryEvent {
+	version, err := c.client.Discovery().ServerVersion()
+	if err != nil {
+		return InventoryEvent{Type: InventoryHealth, Err: fmt.Errorf("getting the API server version: %w", err)}
+	}
+	namespace := v1.NamespaceAll
+	if len(c.config.Namespaces) > 0 {
+		namespace = c.config.Namespaces[0]
+	}
+	if _, err := c.client.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{Limit: 1}); err != nil {
+		return InventoryEvent{Type: InventoryHealth, Err: fmt.Errorf("listing pods: %w", err)}
+	}
+	return InventoryEvent{Type: InventoryHealth, Version: version.GitVersion}
+}
+
+// shutdown waits for the informers to stop so no more callbacks come in after the controller
+// is gone. Only call it once ctx has been cancelled or it'll block forever.
+func (c *Controller) shutdown() {
+	for _, informerFactory := range c.kInformerFactories {
+		informerFactory.Shutdown()
+	}
+	for _, informerFactory := range c.dInformerFactories {
+		informerFactory.Shutdown()
+	}
+	c.eventBroadcaster.Shutdown()
+}
+
 func (c *Controller) runWorker(ctx context.Context) {
 	for c.processNextWorkItem(ctx) {
 	}
@@ -303,76 +536,84 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 Ok, so for this controller we want to get info about all of the deployments in the cluster (it'll be specific ns later)
 I think just as a sanity check let's print out the name, namespace and image of each deployment in the cluster
 */
-func (c *Controller) syncHandler(ctx context.Context, objref cache.ObjectName) error {
+func (c *Controller) syncHandler(ctx context.Context, key WorkloadKey) error {
 
 	logger := klog.FromContext(ctx)
-	msg := fmt.Sprintf("%s : %s | controller: %s", objref.Namespace, objref.Name, c.clusterName)
+	msg := fmt.Sprintf("%s : %s : %s | controller: %s", key.Kind, key.Namespace, key.Name, c.clusterName)
 	logger.Info(msg)
 
-	deploy, err := c.client.AppsV1().Deployments(objref.Namespace).Get(context.TODO(), objref.Name, v1.GetOptions{})
+	kind, known := c.kinds[key.Kind]
+	if !known {
+		return fmt.Errorf("don't know how to sync a %s", key.Kind)
+	}
+
+	// the informers already have the object, no need to ask the API server for it again
+	obj, exists, err := c.getFromInformers(key)
 	if err != nil {
 		return err
 	}
+	if !exists {
+		// it got deleted after it was queued, the delete handler takes care of it
+		return nil
+	}
 
-	replacement := c.deployments[objref.Name]
+	podSpec, err := kind.podSpec(obj)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
 
-	containers := ""
-	for _, container := range deploy.Spec.Template.Spec.Containers {
-		containers += fmt.Sprintf("%s | ", container.Image)
+	containers := containerInfos(podSpec)
+	addDigests(containers, c.podsOf(kind, key))
+	// only this worker syncs this key, so what's stored can't change between here and the update
+	if previous, exists := c.deployments.get(key); exists {
+		downgradeCtx := klog.NewContext(ctx, logger.WithValues("key", key, "controller", c.clusterName))
+		containers = markDowngrades(downgradeCtx, versionOrderFor(serviceKey(key)), previous.Containers, containers)
 	}
 
-	replacement.Image = containers
-	c.deployments[objref.Name] = replacement
+	// if it was deleted while we were asking for it, update doesn't put it back
+	if c.deployments.update(key, func(config *DeployConfigs) {
+		config.Containers = containers
+	}) {
+		c.reportCompliance(ctx, key, obj, containers)
+	}
 	return nil
-	// namespaces, err := c.client.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
-	// if err != nil {
-	// 	return err
-	// }
-
-	// for _, namespace := range namespaces.Items {
-	// 	deployList, err := c.client.AppsV1().Deployments(namespace.Name).List(context.TODO(), metav1.ListOptions{})
-	// 	if err != nil {
-	// 		return err
-	// 	}
-
-	// 	for _, deployment := range deployList.Items {
-	// 		msg := fmt.Sprintf("%s : %s", deployment.Namespace, deployment.Name)
-	// 		logger.Info(msg, "controller", c.clusterName)
-	// 	}
-	// }
+}
 
-	// return nil
+func (c *Controller) getFromInformers(key WorkloadKey) (interface{}, bool, error) {
+	for _, informer := range c.informers[key.Kind] {
+		obj, exists, err := informer.GetIndexer().GetByKey(key.objectName().String())
+		if err != nil || exists {
+			return obj, exists, err
+		}
+	}
+	return nil, false, nil
 }
 
-func (c *Controller) checkToQueue(obj interface{}) {
-	// objref holds the name and namespace of the deployment that was picked up by the informer
+func (c *Controller) checkToQueue(kind string, obj interface{}) {
+	// objref holds the name and namespace of the workload that was picked up by the informer
 	if objref, err := cache.ObjectToName(obj); err != nil {
 		utilruntime.HandleError(err)
 	} else {
-
-		value, exists := c.deployments[objref.Name]
-
-		if !exists {
-			c.deployments[objref.Name] = DeployConfigs{Cluster: c.clusterName, Namespace: objref.Namespace, Image: "No image found"}
-			c.enqueueDeployment(objref)
-
-			serviceNames.checkAndAdd(objref.Name)
-		} else {
-			if value == c.deployments[objref.Name] {
-				return
-			} else {
-				c.enqueueDeployment(objref)
-
-				serviceNames.checkAndAdd(objref.Name)
-			}
+		if kind == kindJob && ownedByCronJob(obj) && len(c.informers[kindCronJob]) > 0 {
+			return
 		}
 
+		key := WorkloadKey{Kind: kind, Namespace: objref.Namespace, Name: objref.Name}
+		// a placeholder until the worker syncs it, updates don't wipe what's been synced already
+		placeholder := DeployConfigs{Cluster: c.clusterName, Kind: kind, Namespace: objref.Namespace, Name: objref.Name, Containers: []ContainerInfo{}}
+		c.deployments.add(key, placeholder)
+		c.enqueueDeployment(key)
 	}
 }
 
-func (c *Controller) enqueueDeployment(objref cache.ObjectName) {
-	klog.InfoS("Adding to queue", "key", objref, "controller", c.clusterName)
-	c.workqueue.Add(objref)
+func (c *Controller) forgetDeployment(ctx context.Context, key WorkloadKey) {
+	c.deployments.remove(key)
+	c.forgetCompliance(key)
+}
+
+func (c *Controller) enqueueDeployment(key WorkloadKey) {
+	klog.InfoS("Adding to queue", "key", key, "controller", c.clusterName)
+	c.workqueue.Add(key)
 }
 
 // func getMasterURL() string {
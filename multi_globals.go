@@ -1,43 +1,40 @@
 package main
 
-import (
-	"context"
-	"fmt"
-	"sync"
+import "fmt"
 
-	"k8s.io/klog/v2"
+/*
+	What makes two deployments "the same service" when we line clusters up next to each other:
+
+	"namespace" (the default): the namespace and the name both have to match, so default/api
+	and payments/api are different services.
+
+	"name": only the name has to match, for when every environment puts its services in its
+	own namespace (api in prod-apps on one cluster and api in staging-apps on another).
+
+	Inside one cluster deployments are always keyed by namespace/name either way.
+*/
+
+const (
+	serviceIdentityNamespace = "namespace"
+	serviceIdentityName      = "name"
 )
 
-// ok, so when a deployment is deleted, we also need to remove it from here?
-// maybe and maybe not... diff clusters can have the same deploy name
-type ServiceNames struct {
-	services map[string]int
-	mutx     sync.Mutex
-}
+var serviceIdentity = serviceIdentityNamespace
 
-func (svcNames *ServiceNames) checkAndAdd(svcName string) {
-	svcNames.mutx.Lock()
-	defer svcNames.mutx.Unlock()
-	if _, exists := svcNames.services[svcName]; !exists {
-		svcNames.services[svcName] = 1
-		return
+func validateServiceIdentity(identity string) error {
+	switch identity {
+	case serviceIdentityNamespace, serviceIdentityName:
+		return nil
+	default:
+		return fmt.Errorf("serviceIdentity has to be %q or %q, not %q", serviceIdentityNamespace, serviceIdentityName, identity)
 	}
-
-	msg := fmt.Sprintf("num: %d", svcNames.services[svcName]+1)
-	klog.Info(msg)
-	svcNames.services[svcName]++
 }
 
-func (svcNames *ServiceNames) decrement(ctx context.Context, svcName string) {
-	svcNames.mutx.Lock()
-	defer svcNames.mutx.Unlock()
-	value := svcNames.services[svcName]
-	logger := klog.FromContext(ctx)
-	msg := fmt.Sprintf("value: %d", value)
-	logger.Info(msg)
-	if value-1 <= 0 {
-		delete(svcNames.services, svcName)
-	} else {
-		svcNames.services[svcName]--
+// serviceKey is the name a workload goes by when it's compared across clusters. The kind isn't
+// part of it, a Deployment that became a StatefulSet somewhere is still the same service.
+func serviceKey(key WorkloadKey) string {
+	if serviceIdentity == serviceIdentityName {
+		return key.Name
 	}
+	return key.objectName().String()
 }
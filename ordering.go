@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+/*
+	Telling two versions apart only needs equality, but "which cluster runs the newest api" and
+	"did that deploy just go backwards" need an order, and tags don't have one we can just
+	assume. Each service gets an ordering strategy (semver unless the config says otherwise):
+
+		semver   - 1.25.3, v2.0.0-rc.1 (1.25 is 1.25.0). A suffix that isn't a prerelease like
+		           -rc.1 or -beta is a variant of the image (1.25.3-alpine), variants are only
+		           ordered against the same variant
+		calver   - 2024.01.3, 24.04 (year, month, then any other numbers)
+		date     - a date stamp anywhere in the tag, 20240131, 2024-01-31, main-20240131-1530
+		build    - a build number, the whole tag or after its last -: 1234, build-1234,
+		           1.4.2-56. Tags with other numbers at the end (1.25.3, v2-alpine3) aren't builds
+		registry - the time the image was built, from the registry, for things that are only
+		           pinned by digest (see registry.go)
+
+	images:
+	  ordering: semver
+	  serviceOrdering:
+	    default/web: date
+	    payments/ledger: registry
+
+	Versions the strategy can't make sense of are left out of the order instead of being guessed at.
+*/
+
+const (
+	orderingSemver   = "semver"
+	orderingCalver   = "calver"
+	orderingDate     = "date"
+	orderingBuild    = "build"
+	orderingRegistry = "registry"
+
+	defaultOrdering = orderingSemver
+)
+
+type versionOrder interface {
+	// prepare looks up whatever compare needs for these containers. compare gets called from
+	// inside sorts, so it doesn't go over the network, anything prepare didn't find isn't ordered.
+	prepare(ctx context.Context, containers []ContainerInfo)
+	// compare is < 0 if a is older than b, 0 if they're the same version and > 0 if a is newer.
+	// ok is false when either of them isn't something this order understands.
+	compare(a, b ContainerInfo) (result int, ok bool)
+}
+
+var versionOrders = map[string]versionOrder{
+	orderingSemver: tagOrder(compareSemver),
+	orderingCalver: tagOrder(compareCalver),
+	orderingDate:   tagOrder(compareDate),
+	orderingBuild:  tagOrder(compareBuild),
+	// the registry client is shared so every service uses the same cache
+	orderingRegistry: registryOrder{registry: newRegistryClient()},
+}
+
+func orderingNames() []string {
+	names := make([]string, 0, len(versionOrders))
+	for name := range versionOrders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateOrdering(name string) error {
+	if _, exists := versionOrders[name]; !exists {
+		return fmt.Errorf("%q isn't an ordering, use one of %s", name, strings.Join(orderingNames(), ", "))
+	}
+	return nil
+}
+
+// orderingFor is the name of the strategy the service's versions are ordered by
+func orderingFor(service string) string {
+	if name, exists := imageSettings.ServiceOrdering[service]; exists {
+		return name
+	}
+	if imageSettings.Ordering != "" {
+		return imageSettings.Ordering
+	}
+	return defaultOrdering
+}
+
+func versionOrderFor(service string) versionOrder {
+	return versionOrders[orderingFor(service)]
+}
+
+// prepareOrders prepares the orders of these services for every container they run, once for
+// the whole request
+func prepareOrders(ctx context.Context, snapshots []ClusterSnapshot, services []string) {
+	byOrdering := make(map[string][]ContainerInfo)
+	for _, service := range services {
+		for _, snapshot := range snapshots {
+			byOrdering[orderingFor(service)] = append(byOrdering[orderingFor(service)], serviceContainers(snapshot, service)...)
+		}
+	}
+	for name, containers := range byOrdering {
+		prepareOrder(ctx, versionOrders[name], containers)
+	}
+}
+
+// prepareOrder is prepare with a deadline, a registry that doesn't answer leaves the versions
+// unordered instead of holding up the request
+func prepareOrder(ctx context.Context, order versionOrder, containers []ContainerInfo) {
+	ctx, cancel := context.WithTimeout(ctx, registryTimeout)
+	defer cancel()
+	order.prepare(ctx, containers)
+}
+
+// tagOrder orders containers by the tag of their (canonical) image
+type tagOrder func(a, b string) (int, bool)
+
+// tags are all there is to it, nothing to look up
+func (order tagOrder) prepare(ctx context.Context, containers []ContainerInfo) {}
+
+func (order tagOrder) compare(a, b ContainerInfo) (int, bool) {
+	aRef, bRef := a.canonicalReference(), b.canonicalReference()
+	if aRef == nil || bRef == nil || aRef.Tag == "" || bRef.Tag == "" {
+		return 0, false
+	}
+	return order(aRef.Tag, bRef.Tag)
+}
+
+func compareSemver(a, b string) (int, bool) {
+	aVersion, aVariant, aOk := semverVariant(a)
+	bVersion, bVariant, bOk := semverVariant(b)
+	if !aOk || !bOk || aVariant != bVariant {
+		return 0, false
+	}
+	return semver.Compare(aVersion, bVersion), true
+}
+
+// prereleasePattern splits what comes after the - into a real prerelease and a variant after it
+var prereleasePattern = regexp.MustCompile(`^(-(?:alpha|beta|rc|pre|preview|dev)(?:[.-]?\d+)*)?((?:-.*)?)$`)
+
+// semverVariant splits 1.25.3-rc.1-alpine into v1.25.3-rc.1 and -alpine. Semver would read
+// the whole suffix as a prerelease, which makes 1.25.3-alpine older than 1.25.3.
+func semverVariant(tag string) (string, string, bool) {
+	version := "v" + strings.TrimPrefix(tag, "v")
+	if !semver.IsValid(version) {
+		return "", "", false
+	}
+	prerelease := semver.Prerelease(version)
+	match := prereleasePattern.FindStringSubmatch(prerelease)
+	if match == nil || match[2] == "" {
+		return version, "", true
+	}
+	return strings.TrimSuffix(version, match[2]), match[2], true
+}
+
+var calverPattern = regexp.MustCompile(`^v?(\d{2}|\d{4})\.(\d{1,2})((?:[.-]\d+)*)`)
+
+func compareCalver(a, b string) (int, bool) {
+	aParts, aOk := calverParts(a)
+	bParts, bOk := calverParts(b)
+	if !aOk || !bOk {
+		return 0, false
+	}
+	return compareNumbers(aParts, bParts), true
+}
+
+func calverParts(tag string) ([]int, bool) {
+	match := calverPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return nil, false
+	}
+	month, _ := strconv.Atoi(match[2])
+	if month < 1 || month > 12 {
+		return nil, false
+	}
+	year, _ := strconv.Atoi(match[1])
+	if len(match[1]) == 2 {
+		year += 2000
+	}
+	parts := []int{year, month}
+	for _, part := range strings.FieldsFunc(match[3], func(r rune) bool { return r == '.' || r == '-' }) {
+		number, _ := strconv.Atoi(part)
+		parts = append(parts, number)
+	}
+	return parts, true
+}
+
+// datePattern is a date with an optional time after it, with or without separators
+var datePattern = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})(?:[T_.-]?(\d{2}):?(\d{2})(?::?(\d{2}))?)?`)
+
+func compareDate(a, b string) (int, bool) {
+	aTime, aOk := tagDate(a)
+	bTime, bOk := tagDate(b)
+	if !aOk || !bOk {
+		return 0, false
+	}
+	return aTime.Compare(bTime), true
+}
+
+func tagDate(tag string) (time.Time, bool) {
+	for _, match := range datePattern.FindAllStringSubmatch(tag, -1) {
+		numbers := make([]int, 6)
+		for index, part := range match[1:] {
+			numbers[index], _ = strconv.Atoi(part)
+		}
+		date := time.Date(numbers[0], time.Month(numbers[1]), numbers[2], numbers[3], numbers[4], numbers[5], 0, time.UTC)
+		// time.Date happily turns month 13 into next January, a real date comes back the same
+		if date.Year() == numbers[0] && int(date.Month()) == numbers[1] && date.Day() == numbers[2] && numbers[3] < 24 && numbers[4] < 60 && numbers[5] < 60 {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// buildPattern is a tag that's all digits or ends in -N
+var buildPattern = regexp.MustCompile(`^(?:.*-)?(\d+)$`)
+
+func compareBuild(a, b string) (int, bool) {
+	aMatch, bMatch := buildPattern.FindStringSubmatch(a), buildPattern.FindStringSubmatch(b)
+	if aMatch == nil || bMatch == nil {
+		return 0, false
+	}
+	aBuild, aErr := strconv.ParseUint(aMatch[1], 10, 64)
+	bBuild, bErr := strconv.ParseUint(bMatch[1], 10, 64)
+	if aErr != nil || bErr != nil {
+		return 0, false
+	}
+	switch {
+	case aBuild < bBuild:
+		return -1, true
+	case aBuild > bBuild:
+		return 1, true
+	}
+	return 0, true
+}
+
+func compareNumbers(a, b []int) int {
+	for index := 0; index < len(a) || index < len(b); index++ {
+		var aPart, bPart int
+		if index < len(a) {
+			aPart = a[index]
+		}
+		if index < len(b) {
+			bPart = b[index]
+		}
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// registryOrder orders containers by when their image was built, which is the only order
+// there is for images that are only pinned by digest
+type registryOrder struct {
+	registry *registryClient
+}
+
+// prepare looks up the images that aren't cached yet, all at once
+func (order registryOrder) prepare(ctx context.Context, containers []ContainerInfo) {
+	lookups := make(map[registryImage]bool)
+	for _, container := range containers {
+		if image, err := order.image(container); err == nil && !order.registry.isCached(image) {
+			lookups[image] = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	running := make(chan struct{}, registryLookups)
+	for image := range lookups {
+		wg.Add(1)
+		go func(image registryImage) {
+			defer wg.Done()
+			running <- struct{}{}
+			defer func() { <-running }()
+			// the error is cached with the rest, compare finds it there
+			order.registry.created(ctx, image)
+		}(image)
+	}
+	wg.Wait()
+}
+
+func (order registryOrder) compare(a, b ContainerInfo) (int, bool) {
+	aTime, aErr := order.created(a)
+	bTime, bErr := order.created(b)
+	if aErr != nil || bErr != nil {
+		return 0, false
+	}
+	return aTime.Compare(bTime), true
+}
+
+// created is what the last lookup of the container's image found
+func (order registryOrder) created(container ContainerInfo) (time.Time, error) {
+	image, err := order.image(container)
+	if err != nil {
+		return time.Time{}, err
+	}
+	lookup, cached := order.registry.cached(image)
+	if !cached {
+		return time.Time{}, fmt.Errorf("image %s hasn't been looked up", container.Image)
+	}
+	return lookup.created, lookup.err
+}
+
+// image is the digest to look up for the container
+func (order registryOrder) image(container ContainerInfo) (registryImage, error) {
+	// ask the registry it was really pulled from, the canonical one might not be reachable from here
+	ref := container.Reference
+	if ref == nil {
+		return registryImage{}, fmt.Errorf("couldn't parse image %s", container.Image)
+	}
+	// the digest in the image wins, then what the pods are running if they all run the same thing
+	digest := ref.Digest
+	if digest == "" && len(container.Digests) == 1 {
+		digest = container.Digests[0]
+	}
+	if digest == "" {
+		return registryImage{}, fmt.Errorf("image %s has no digest to look up", container.Image)
+	}
+	return registryImage{host: ref.Registry, repository: ref.Repository, digest: digest}, nil
+}
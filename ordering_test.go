@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type orderingCase struct {
+	a, b   string
+	result int
+	ok     bool
+}
+
+func testTagOrdering(t *testing.T, compare func(a, b string) (int, bool), cases []orderingCase) {
+	t.Helper()
+	for _, test := range cases {
+		result, ok := compare(test.a, test.b)
+		if ok != test.ok || (ok && sign(result) != test.result) {
+			t.Errorf("comparing %q with %q = %d, %t, want %d, %t", test.a, test.b, result, ok, test.result, test.ok)
+		}
+	}
+}
+
+func sign(number int) int {
+	switch {
+	case number < 0:
+		return -1
+	case number > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestCompareSemver(t *testing.T) {
+	testTagOrdering(t, compareSemver, []orderingCase{
+		{"1.25.3", "1.25.3", 0, true},
+		{"1.25.3", "1.26.0", -1, true},
+		{"1.26.0", "1.25.3", 1, true},
+		{"v1.2.3", "1.2.3", 0, true},
+		{"v2.0.0", "v10.0.0", -1, true},
+		{"1.25", "1.25.0", 0, true},
+		{"2.0.0-rc.1", "2.0.0", -1, true},
+		{"2.0.0-beta", "2.0.0-rc.1", -1, true},
+		// variants are only ordered against the same variant
+		{"1.25.3-alpine", "1.26.0-alpine", -1, true},
+		{"1.25.3-alpine3.18", "1.25.3-alpine3.18", 0, true},
+		{"2.0.0-rc.1-alpine", "2.0.0-alpine", -1, true},
+		{"1.25.3", "1.25.3-alpine", 0, false},
+		{"1.26.0-slim", "1.25.3-alpine", 0, false},
+		{"latest", "1.2.3", 0, false},
+		{"1.2.3", "main-abc123", 0, false},
+	})
+}
+
+func TestCompareCalver(t *testing.T) {
+	testTagOrdering(t, compareCalver, []orderingCase{
+		{"2024.01.3", "2024.01.3", 0, true},
+		{"2024.01.3", "2024.02.1", -1, true},
+		{"2024.10", "2024.9", 1, true},
+		{"24.04", "2024.04", 0, true},
+		{"v2024.01.3", "2024.01.2", 1, true},
+		{"2024.01.3-alpine", "2024.01.4-alpine", -1, true},
+		{"2024.13.1", "2024.01.1", 0, false},
+		{"latest", "2024.01", 0, false},
+	})
+}
+
+func TestCompareDate(t *testing.T) {
+	testTagOrdering(t, compareDate, []orderingCase{
+		{"20240131", "2024-01-31", 0, true},
+		{"main-20240131-1530", "main-20240131-0900", 1, true},
+		{"20240131", "20240201", -1, true},
+		{"v20231231-alpine", "20240101", -1, true},
+		{"20241331", "20240101", 0, false},
+		{"latest", "20240101", 0, false},
+	})
+}
+
+func TestCompareBuild(t *testing.T) {
+	testTagOrdering(t, compareBuild, []orderingCase{
+		{"1234", "1234", 0, true},
+		{"build-99", "build-100", -1, true},
+		{"1235", "build-1234", 1, true},
+		{"1.4.2-56", "1.4.2-7", 1, true},
+		{"main-abc123-45", "main-def456-46", -1, true},
+		{"1.25.3", "1.26.0", 0, false},
+		{"v2-alpine3", "v10-alpine3", 0, false},
+		{"build-12-alpine", "build-13", 0, false},
+		{"latest", "1234", 0, false},
+	})
+}
+
+func TestTagOrderUsesTheImageTag(t *testing.T) {
+	cases := []struct {
+		a, b   string
+		result int
+		ok     bool
+	}{
+		{"nginx:1.25.3", "docker.io/library/nginx:1.26.0", -1, true},
+		{"registry.example.com:5000/api:v2.0.0", "registry.example.com:5000/api:v1.9.9", 1, true},
+		// no tag to order by
+		{"nginx@" + testDigest("a"), "nginx:1.25.3", 0, false},
+		{"nginx", "nginx:1.25.3", 0, false},
+	}
+	for _, test := range cases {
+		result, ok := tagOrder(compareSemver).compare(newContainerInfo("app", test.a, false, false), newContainerInfo("app", test.b, false, false))
+		if ok != test.ok || (ok && sign(result) != test.result) {
+			t.Errorf("comparing %s with %s = %d, %t, want %d, %t", test.a, test.b, result, ok, test.result, test.ok)
+		}
+	}
+}
+
+func TestRegistryOrder(t *testing.T) {
+	older, newer := testDigest("1"), testDigest("2")
+	registry := newRegistryClient()
+	now := time.Now()
+	nginx := registryImage{host: "docker.io", repository: "library/nginx"}
+	for digest, lookup := range map[string]registryLookup{
+		older:           {created: now.Add(-time.Hour), at: now},
+		newer:           {created: now, at: now},
+		testDigest("3"): {err: errors.New("unreachable"), at: now},
+	} {
+		nginx.digest = digest
+		registry.cache[nginx] = lookup
+	}
+	order := registryOrder{registry: registry}
+
+	running := newContainerInfo("app", "nginx:latest", false, false)
+	running.Digests = []string{older}
+
+	cases := []struct {
+		name   string
+		a, b   ContainerInfo
+		result int
+		ok     bool
+	}{
+		{"same digest", newContainerInfo("app", "nginx@"+newer, false, false), newContainerInfo("app", "nginx:1.25@"+newer, false, false), 0, true},
+		{"newer build", newContainerInfo("app", "nginx@"+newer, false, false), newContainerInfo("app", "nginx@"+older, false, false), 1, true},
+		{"digest from the pods", running, newContainerInfo("app", "nginx@"+newer, false, false), -1, true},
+		{"no digest", newContainerInfo("app", "nginx:latest", false, false), newContainerInfo("app", "nginx@"+newer, false, false), 0, false},
+		{"lookup failed", newContainerInfo("app", "nginx@"+testDigest("3"), false, false), newContainerInfo("app", "nginx@"+newer, false, false), 0, false},
+		// compare doesn't look anything up, prepare does
+		{"not looked up", newContainerInfo("app", "nginx@"+testDigest("4"), false, false), newContainerInfo("app", "nginx@"+newer, false, false), 0, false},
+	}
+	for _, test := range cases {
+		result, ok := order.compare(test.a, test.b)
+		if ok != test.ok || (ok && sign(result) != test.result) {
+			t.Errorf("%s: got %d, %t, want %d, %t", test.name, result, ok, test.result, test.ok)
+		}
+	}
+}
+
+func TestRegistryOrderPrepare(t *testing.T) {
+	older, newer, missing := testDigest("1"), testDigest("2"), testDigest("3")
+	configs := map[string]string{older: testDigest("a"), newer: testDigest("b")}
+	created := map[string]time.Time{testDigest("a"): time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), testDigest("b"): time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		digest := path.Base(req.URL.Path)
+		switch {
+		case strings.Contains(req.URL.Path, "/manifests/") && configs[digest] != "":
+			fmt.Fprintf(writer, `{"config": {"digest": %q}}`, configs[digest])
+		case strings.Contains(req.URL.Path, "/blobs/") && !created[digest].IsZero():
+			fmt.Fprintf(writer, `{"created": %q}`, created[digest].Format(time.RFC3339))
+		default:
+			http.NotFound(writer, req)
+		}
+	}))
+	defer server.Close()
+
+	// 127.0.0.1 is asked over plain http
+	host := strings.TrimPrefix(server.URL, "http://")
+	order := registryOrder{registry: newRegistryClient()}
+	container := func(digest string) ContainerInfo {
+		return newContainerInfo("app", host+"/app@"+digest, false, false)
+	}
+	containers := []ContainerInfo{container(older), container(newer), container(missing), container(older)}
+	order.prepare(context.Background(), containers)
+	if requests.Load() != 5 {
+		t.Errorf("prepare made %d requests, want 5", requests.Load())
+	}
+	if result, ok := order.compare(container(newer), container(older)); !ok || result <= 0 {
+		t.Errorf("comparing the newer image with the older one = %d, %t, want > 0, true", result, ok)
+	}
+	if _, ok := order.compare(container(missing), container(older)); ok {
+		t.Errorf("an image the registry doesn't have was ordered")
+	}
+
+	// everything is cached now, failures included
+	order.prepare(context.Background(), containers)
+	if requests.Load() != 5 {
+		t.Errorf("preparing again made %d more requests, want none", requests.Load()-5)
+	}
+}
+
+// testDigest is a made up sha256 digest
+func testDigest(fill string) string {
+	digest := "sha256:"
+	for len(digest) < len("sha256:")+64 {
+		digest += fill
+	}
+	return digest
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -32,12 +34,26 @@ const (
 */
 
 type ClusterInfo struct {
-	ClusterName      string            `json:"clusterName"`
-	ServiceImagePair map[string]string `json:"serviceImagePair"`
-	Date             string            `json:"date"`
+	ClusterName string            `json:"clusterName"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Services    []ServiceInfo     `json:"services"`
+	Date        string            `json:"date"`
+	// only set for a cluster that isn't ready, see health.go
+	State     string `json:"state,omitempty"`
+	LastError string `json:"lastError,omitempty"`
 }
 
-func formatData(ctx context.Context, controllers *map[string]*Controller, services *ServiceNames) bool {
+// ServiceInfo is one workload in a cluster. Service is the key it's lined up with
+// across clusters (see serviceKey), Kind, Namespace and Name are where it actually lives.
+type ServiceInfo struct {
+	Service    string          `json:"service"`
+	Kind       string          `json:"kind"`
+	Namespace  string          `json:"namespace"`
+	Name       string          `json:"name"`
+	Containers []ContainerInfo `json:"containers"`
+}
+
+func formatData(ctx context.Context, snapshots []ClusterSnapshot) bool {
 	/*
 		Ok, so just as our first go, we want to take the names of the clusters
 		and make a column for each of them within the html file.
@@ -49,27 +65,85 @@ func formatData(ctx context.Context, controllers *map[string]*Controller, servic
 		return false
 	}
 
-	copy := *controllers // So I don't copy the controllers for each for loop (that's also why I pass it in as a pointer)
+	// the snapshots are sorted by cluster, so the header and every row have their columns in the same order
 	clusters := ""
-	for cluster := range copy {
-		clusters += strings.Replace(CLUSTER, "__CLUSTER__", cluster, 1)
+	for _, snapshot := range snapshots {
+		name := snapshot.ClusterName
+		if snapshot.State == clusterUnavailable {
+			name += "<br>unavailable: " + html.EscapeString(snapshot.LastError)
+		}
+		clusters += strings.Replace(CLUSTER, "__CLUSTER__", name, 1)
+	}
+	// the drift column is only there when there's a reference to drift from
+	drift := make(map[string]ServiceDrift)
+	if report, err := driftReport(ctx, driftSettings, servingSnapshots(snapshots)); err == nil {
+		clusters += strings.Replace(CLUSTER, "__CLUSTER__", "Drift from "+strings.Join(report.Reference, ", "), 1)
+		for _, service := range report.Services {
+			drift[service.Service] = service
+		}
 	}
 
 	// ------------------------
 
 	rows := ""
-	for service := range services.services {
+	for _, service := range serviceKeys(snapshots) {
 		rowInner := ""
 
 		rowInner += strings.Replace(SERVICE, "__SERVICE__", service, 1)
-		for _, controller := range copy {
-			if config, exists := controller.deployments[service]; exists {
-				str := strings.Replace(VERSION, "__VERSION__", config.Image, 1)
-				str = strings.Replace(str, "__COLOR__", hash(config.Image), 1)
+		for _, snapshot := range snapshots {
+			if snapshot.State == clusterUnavailable {
+				str := strings.Replace(VERSION, "__VERSION__", "Unavailable", 1)
+				rowInner += strings.Replace(str, "__COLOR__", "e0e0e0", 1)
+				continue
+			}
+			// when services are matched by name alone, or the same name is used by more than one kind,
+			// a cluster can have more than one of them
+			matching := []DeployConfigs{}
+			for key, config := range snapshot.Workloads {
+				if serviceKey(key) == service {
+					matching = append(matching, config)
+				}
+			}
+			versions := []string{}
+			// what the colour comes from, with mirrors and matchDigests (images.go) two cells can
+			// say different things and still be the same version
+			compared := []string{}
+			for _, config := range matching {
+				compared = append(compared, versionKeys(config.Containers))
+				prefix := ""
+				if len(matching) > 1 {
+					prefix = config.Kind + " "
+				}
+				if serviceIdentity == serviceIdentityName {
+					prefix += config.Namespace
+				}
+				if prefix != "" {
+					versions = append(versions, fmt.Sprintf("%s: %s", strings.TrimSpace(prefix), formatContainers(config.Containers)))
+				} else {
+					versions = append(versions, formatContainers(config.Containers))
+				}
+			}
+			sort.Strings(versions)
+			sort.Strings(compared)
+
+			if len(versions) > 0 {
+				version := strings.Join(versions, "<br>")
+				str := strings.Replace(VERSION, "__VERSION__", version, 1)
+				str = strings.Replace(str, "__COLOR__", hash(strings.Join(compared, "\n")), 1)
 				rowInner += str
 			} else {
-				rowInner += strings.Replace(VERSION, "__VERSION__", "No image found", 1)
+				str := strings.Replace(VERSION, "__VERSION__", "No image found", 1)
+				rowInner += strings.Replace(str, "__COLOR__", "ffffff", 1)
+			}
+		}
+		if len(drift) > 0 {
+			summary := driftSummary(drift[service])
+			color := "c8e6c9"
+			if summary != driftInSync {
+				color = "ffe0b2"
 			}
+			str := strings.Replace(VERSION, "__VERSION__", summary, 1)
+			rowInner += strings.Replace(str, "__COLOR__", color, 1)
 		}
 
 		row := strings.Replace(ROW, "__ROW__", rowInner, 1)
@@ -90,11 +164,102 @@ func formatData(ctx context.Context, controllers *map[string]*Controller, servic
 	fileContent = strings.Replace(fileContent, "__VERSIONS__", rows, 1)
 	os.WriteFile("./out/allCoallated.html", []byte(fileContent), 0644)
 
-	getAllClustersData()
-
 	return true
 }
 
+// formatContainers is the images of a workload for its cell in the table
+func formatContainers(containers []ContainerInfo) string {
+	if len(containers) == 0 {
+		return "No image found"
+	}
+	images := make([]string, 0, len(containers))
+	for _, container := range containers {
+		image := container.displayImage()
+		if container.Init {
+			image += " (init)"
+		} else if container.Ephemeral {
+			image += " (ephemeral)"
+		}
+		if container.MixedDigests {
+			image += " (mixed digests)"
+		}
+		images = append(images, image)
+	}
+	return strings.Join(images, ", ")
+}
+
+// versionKeys is what a workload's cell is compared by, see versionKey
+func versionKeys(containers []ContainerInfo) string {
+	keys := make([]string, 0, len(containers))
+	for _, container := range containers {
+		keys = append(keys, container.versionKey())
+	}
+	return strings.Join(keys, ",")
+}
+
+// digestConflicts is every image (as written in the pod templates) that runs with different
+// digests in different clusters, like a latest tag that was pulled at different times. A
+// container whose pods don't agree on a digest yet is left out, that's a rollout (or a
+// restart that pulled again) still going and its cell says mixed digests already.
+func digestConflicts(snapshots []ClusterSnapshot) map[string]bool {
+	digests := make(map[string]map[string]map[string]bool) // image -> digest -> clusters
+	for _, snapshot := range snapshots {
+		for _, config := range snapshot.Workloads {
+			for _, container := range config.Containers {
+				if container.MixedDigests {
+					continue
+				}
+				image := container.normalizedImage()
+				for _, digest := range container.Digests {
+					if digests[image] == nil {
+						digests[image] = make(map[string]map[string]bool)
+					}
+					if digests[image][digest] == nil {
+						digests[image][digest] = make(map[string]bool)
+					}
+					digests[image][digest][snapshot.ClusterName] = true
+				}
+			}
+		}
+	}
+
+	conflicts := make(map[string]bool)
+	for image, byDigest := range digests {
+		if len(byDigest) < 2 {
+			continue
+		}
+		// a rollout in one cluster isn't a conflict between clusters, some digest has to be missing from a cluster that has another one
+		clusters := make(map[string]bool)
+		for _, inClusters := range byDigest {
+			for cluster := range inClusters {
+				clusters[cluster] = true
+			}
+		}
+		for _, inClusters := range byDigest {
+			if len(inClusters) < len(clusters) {
+				conflicts[image] = true
+			}
+		}
+	}
+	return conflicts
+}
+
+// serviceKeys is every service in the snapshots, sorted
+func serviceKeys(snapshots []ClusterSnapshot) []string {
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, snapshot := range snapshots {
+		for workload := range snapshot.Workloads {
+			if key := serviceKey(workload); !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func hash(convert string) string {
 	var total int = 0
 	for i := 0; i < len(convert); i++ {
@@ -123,20 +288,7 @@ func hash(convert string) string {
 }
 
 func getAllClustersData() ([]byte, error) {
-	var clusters []ClusterInfo
-	timeToSend := time.Now().Format("2006-January-02")
-	for cluster, controller := range Controllers {
-		var pairs = make(map[string]string)
-		for serviceName, image := range controller.deployments {
-			pairs[serviceName] = image.Image
-		}
-
-		clusters = append(clusters, ClusterInfo{
-			ClusterName:      cluster,
-			ServiceImagePair: pairs,
-			Date:             timeToSend,
-		})
-	}
+	clusters := clusterInfos(Controllers.snapshot(), time.Now())
 
 	j, err := json.Marshal(clusters)
 	if err != nil {
@@ -146,3 +298,42 @@ func getAllClustersData() ([]byte, error) {
 		return j, nil
 	}
 }
+
+// clusterInfos is what / sends for the snapshots, /history sends the same for the past
+func clusterInfos(snapshots []ClusterSnapshot, date time.Time) []ClusterInfo {
+	clusters := []ClusterInfo{}
+	timeToSend := date.Format("2006-January-02")
+	conflicts := digestConflicts(snapshots)
+	for _, snapshot := range snapshots {
+		services := []ServiceInfo{}
+		for _, key := range sortedWorkloadKeys(snapshot.Workloads) {
+			// the snapshot shares its container slices with the store, so copy before flagging
+			containers := append([]ContainerInfo{}, snapshot.Workloads[key].Containers...)
+			for index := range containers {
+				containers[index].DigestConflict = conflicts[containers[index].normalizedImage()]
+				if canonical := containers[index].canonicalReference(); canonical != nil && *canonical != *containers[index].Reference {
+					containers[index].Canonical = canonical.String()
+				}
+			}
+			services = append(services, ServiceInfo{
+				Service:    serviceKey(key),
+				Kind:       key.Kind,
+				Namespace:  key.Namespace,
+				Name:       key.Name,
+				Containers: containers,
+			})
+		}
+
+		cluster := ClusterInfo{
+			ClusterName: snapshot.ClusterName,
+			Labels:      snapshot.Labels,
+			Services:    services,
+			Date:        timeToSend,
+		}
+		if snapshot.State != clusterReady {
+			cluster.State, cluster.LastError = snapshot.State, snapshot.LastError
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+/*
+	The image in the pod template is only what was asked for, nginx:latest could be anything.
+	What's really running is in the pods' containerStatuses[].imageID, so we watch the pods too
+	and find the workload each one belongs to by following the owner references up (a Deployment's
+	pods belong to a ReplicaSet, a CronJob's to a Job). Every pod event requeues its workload and
+	the sync collects the digests of all its pods. A container with more than one digest means the
+	pods of the workload aren't all running the same thing, usually a rollout that's in progress or
+	a tag that got pushed over while pods were being scheduled.
+
+	Custom resources work the same way as long as they own their pods or ReplicaSets directly
+	(Argo Rollouts do).
+*/
+
+const (
+	kindReplicaSet = "ReplicaSet"
+
+	// indexes pods, ReplicaSets and Jobs by "Kind/namespace/name" of their controller
+	ownerIndex = "owner"
+
+	// how far up (or down) the owner references to go, Deployment -> ReplicaSet -> Pod is two
+	maxOwnerDepth = 3
+)
+
+func ownerIndexFunc(obj interface{}) ([]string, error) {
+	object, err := metaObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	owner := v1.GetControllerOfNoCopy(object)
+	if owner == nil {
+		return nil, nil
+	}
+	return []string{ownerIndexKey(owner.Kind, object.GetNamespace(), owner.Name)}, nil
+}
+
+func ownerIndexKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+// newPodInformer only keeps what we need out of each pod, there are a lot more of them than
+// workloads and the rest of the spec would just sit in memory
+func newPodInformer(namespace string) func(kubernetes.Interface, time.Duration) cache.SharedIndexInformer {
+	return func(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+		informer := coreinformers.NewFilteredPodInformer(client, namespace, resyncPeriod, cache.Indexers{ownerIndex: ownerIndexFunc}, nil)
+		utilruntime.Must(informer.SetTransform(trimPod))
+		return informer
+	}
+}
+
+func trimPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			OwnerReferences: pod.OwnerReferences,
+		},
+		Status: corev1.PodStatus{
+			InitContainerStatuses:      pod.Status.InitContainerStatuses,
+			ContainerStatuses:          pod.Status.ContainerStatuses,
+			EphemeralContainerStatuses: pod.Status.EphemeralContainerStatuses,
+		},
+	}, nil
+}
+
+// watchPods sets up the pod informer and the informers for what sits between a workload
+// and its pods, for one namespace factory
+func (c *Controller) watchPods(factory kubeinformers.SharedInformerFactory, namespace string) {
+	pods := factory.InformerFor(&corev1.Pod{}, newPodInformer(namespace))
+	c.podInformers = append(c.podInformers, pods)
+
+	// the factory hands back the same Job informer we might already track Jobs with
+	middle := map[string]cache.SharedIndexInformer{
+		kindReplicaSet: factory.Apps().V1().ReplicaSets().Informer(),
+		kindJob:        factory.Batch().V1().Jobs().Informer(),
+	}
+	for kind, informer := range middle {
+		utilruntime.Must(informer.AddIndexers(cache.Indexers{ownerIndex: ownerIndexFunc}))
+		c.ownerInformers[kind] = append(c.ownerInformers[kind], informer)
+	}
+}
+
+// addPodHandlers requeues the workload a pod belongs to whenever the pod changes
+func (c *Controller) addPodHandlers() {
+	enqueueOwner := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if key, found := c.workloadOf(obj); found {
+			c.enqueueDeployment(key)
+		}
+	}
+	for _, informer := range c.podInformers {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: enqueueOwner,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldPod, oldOk := oldObj.(*corev1.Pod)
+				newPod, newOk := newObj.(*corev1.Pod)
+				if oldOk && newOk && oldPod.ResourceVersion == newPod.ResourceVersion {
+					return
+				}
+				enqueueOwner(newObj)
+			},
+			DeleteFunc: enqueueOwner,
+		})
+	}
+}
+
+// workloadOf follows the owner references of a pod up to the highest one we track, so a
+// pod of a Job that a CronJob made belongs to the CronJob and not the Job
+func (c *Controller) workloadOf(obj interface{}) (WorkloadKey, bool) {
+	object, err := metaObject(obj)
+	if err != nil {
+		return WorkloadKey{}, false
+	}
+
+	var key WorkloadKey
+	found := false
+	owner := v1.GetControllerOfNoCopy(object)
+	for depth := 0; owner != nil && depth < maxOwnerDepth; depth++ {
+		if tracked, exists := c.ownerKinds[owner.Kind]; exists {
+			key = WorkloadKey{Kind: tracked, Namespace: object.GetNamespace(), Name: owner.Name}
+			found = true
+		}
+		parent, exists := c.getOwner(owner.Kind, object.GetNamespace(), owner.Name)
+		if !exists {
+			break
+		}
+		owner = v1.GetControllerOfNoCopy(parent)
+	}
+	return key, found
+}
+
+func (c *Controller) getOwner(kind, namespace, name string) (v1.Object, bool) {
+	for _, informer := range c.ownerInformers[kind] {
+		obj, exists, err := informer.GetIndexer().GetByKey(cache.ObjectName{Namespace: namespace, Name: name}.String())
+		if err != nil || !exists {
+			continue
+		}
+		if object, err := metaObject(obj); err == nil {
+			return object, true
+		}
+	}
+	return nil, false
+}
+
+// podsOf is every pod under the workload, going down through its ReplicaSets or Jobs
+func (c *Controller) podsOf(kind workloadKind, key WorkloadKey) []*corev1.Pod {
+	var pods []*corev1.Pod
+	owners := []string{ownerIndexKey(kind.ownerKind, key.Namespace, key.Name)}
+	for depth := 0; len(owners) > 0 && depth < maxOwnerDepth; depth++ {
+		var next []string
+		for _, owner := range owners {
+			for _, informer := range c.podInformers {
+				children, _ := informer.GetIndexer().ByIndex(ownerIndex, owner)
+				for _, child := range children {
+					if pod, ok := child.(*corev1.Pod); ok {
+						pods = append(pods, pod)
+					}
+				}
+			}
+			for middleKind, informers := range c.ownerInformers {
+				for _, informer := range informers {
+					children, _ := informer.GetIndexer().ByIndex(ownerIndex, owner)
+					for _, child := range children {
+						if object, err := metaObject(child); err == nil {
+							next = append(next, ownerIndexKey(middleKind, object.GetNamespace(), object.GetName()))
+						}
+					}
+				}
+			}
+		}
+		owners = next
+	}
+	return pods
+}
+
+// addDigests fills in the digests the workload's pods are running for each container. Pods
+// that were made from an older template with another image (the old ReplicaSet halfway
+// through a rollout) are left out, their digests belong to that image and not this one.
+func addDigests(containers []ContainerInfo, pods []*corev1.Pod) {
+	images := make(map[string]string, len(containers))
+	for _, container := range containers {
+		images[container.Name] = container.Image
+	}
+
+	digests := make(map[string]map[string]bool)
+	for _, pod := range pods {
+		podImages := make(map[string]string)
+		for _, container := range containerInfos(&pod.Spec) {
+			podImages[container.Name] = container.Image
+		}
+		statuses := [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses}
+		for _, list := range statuses {
+			for _, status := range list {
+				digest := imageDigest(status.ImageID)
+				if digest == "" || podImages[status.Name] != images[status.Name] {
+					continue
+				}
+				if digests[status.Name] == nil {
+					digests[status.Name] = make(map[string]bool)
+				}
+				digests[status.Name][digest] = true
+			}
+		}
+	}
+
+	for index := range containers {
+		found := digests[containers[index].Name]
+		if len(found) == 0 {
+			continue
+		}
+		list := make([]string, 0, len(found))
+		for digest := range found {
+			list = append(list, digest)
+		}
+		sort.Strings(list)
+		containers[index].Digests = list
+		containers[index].MixedDigests = len(list) > 1
+	}
+}
+
+// imageDigest pulls the digest out of an imageID, which depending on the container runtime looks
+// like docker-pullable://nginx@sha256:... or docker.io/library/nginx@sha256:... A bare
+// sha256:... is the ID of the image's config (a local image, or a runtime that doesn't say
+// where it pulled from), which isn't the digest anything else knows it by, so it's skipped.
+func imageDigest(imageID string) string {
+	if repository, digest, found := strings.Cut(imageID, "@"); found && repository != "" && strings.HasPrefix(digest, "sha256:") {
+		return digest
+	}
+	return ""
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+/*
+	Versions go dev -> staging -> prod. The stages are listed in order in the config file, each
+	one is some clusters by name or by their labels (a cluster only belongs to the first stage
+	it matches):
+
+	promotion:
+	  stages:
+	    - name: dev
+	      clusters: [dev]
+	    - name: staging
+	      selector: env=staging
+	    - name: prod
+	      clusters: [prod-us, prod-eu]
+
+	GET /promotion (or /promotion/default/api for one service) lists, for every container of
+	every service, each version running somewhere in the pipeline newest first with:
+		- the stages it got to and when it first showed up in each (see history.go), and how
+		  long it sat in the stage before
+		- the furthest stage it reached and, if that's not the last one, how long it's been
+		  waiting there
+	and the skipped promotions: versions running in a stage that some earlier stage never ran.
+*/
+
+type PromotionConfig struct {
+	Stages []PromotionStage `json:"stages"`
+}
+
+type PromotionStage struct {
+	Name     string   `json:"name"`
+	Clusters []string `json:"clusters,omitempty"`
+	Selector string   `json:"selector,omitempty"`
+}
+
+var promotionSettings PromotionConfig
+
+func validatePromotionConfig(promotion *PromotionConfig) error {
+	var problems []string
+	if len(promotion.Stages) < 2 {
+		problems = append(problems, "promotion: a pipeline needs at least two stages")
+	}
+	names := make(map[string]bool)
+	for index, stage := range promotion.Stages {
+		switch {
+		case stage.Name == "":
+			problems = append(problems, fmt.Sprintf("promotion.stages[%d]: name is required", index))
+		case names[stage.Name]:
+			problems = append(problems, fmt.Sprintf("promotion.stages[%d]: %q is used by more than one stage", index, stage.Name))
+		}
+		names[stage.Name] = true
+		if len(stage.Clusters) == 0 && stage.Selector == "" {
+			problems = append(problems, fmt.Sprintf("promotion.stages[%d]: needs clusters or a selector", index))
+		}
+		if stage.Selector != "" {
+			if _, err := labels.Parse(stage.Selector); err != nil {
+				problems = append(problems, fmt.Sprintf("promotion.stages[%d].selector: %s", index, err.Error()))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// stageOf is the index of the stage the cluster belongs to, or -1
+func (promotion PromotionConfig) stageOf(snapshot ClusterSnapshot) int {
+	for index, stage := range promotion.Stages {
+		for _, cluster := range stage.Clusters {
+			if cluster == snapshot.ClusterName {
+				return index
+			}
+		}
+		if stage.Selector != "" {
+			if selector, err := labels.Parse(stage.Selector); err == nil && selector.Matches(labels.Set(snapshot.Labels)) {
+				return index
+			}
+		}
+	}
+	return -1
+}
+
+type ServicePromotion struct {
+	Service    string               `json:"service"`
+	Ordering   string               `json:"ordering"`
+	Containers []ContainerPromotion `json:"containers"`
+}
+
+type ContainerPromotion struct {
+	Name     string             `json:"name"`
+	Versions []VersionPromotion `json:"versions"`
+	Skipped  []SkippedPromotion `json:"skipped"`
+}
+
+type VersionPromotion struct {
+	Image   string         `json:"image"`
+	Running []string       `json:"running"`
+	Stages  []StageArrival `json:"stages"`
+	Reached string         `json:"reached"`
+	// how long it's been in the stage it reached without going any further
+	Waiting      string     `json:"waiting,omitempty"`
+	WaitingSince *time.Time `json:"waitingSince,omitempty"`
+
+	container ContainerInfo
+}
+
+type StageArrival struct {
+	Stage string    `json:"stage"`
+	Since time.Time `json:"since"`
+	// how long it was in the stage before until it got here
+	After string `json:"after,omitempty"`
+}
+
+type SkippedPromotion struct {
+	Image    string   `json:"image"`
+	Stage    string   `json:"stage"`
+	Clusters []string `json:"clusters"`
+	// the earlier stages that never ran it
+	Skipped []string `json:"skipped"`
+}
+
+func registerPromotionHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /promotion", func(writer http.ResponseWriter, req *http.Request) {
+		if len(promotionSettings.Stages) == 0 {
+			writeJSON(writer, http.StatusBadRequest, apiError{Error: "no promotion pipeline, add promotion.stages to the config file"})
+			return
+		}
+		snapshots := pipelineSnapshots(promotionSettings, servingSnapshots(Controllers.snapshot()))
+		promotions := []ServicePromotion{}
+		services := serviceKeys(snapshots)
+		prepareOrders(req.Context(), snapshots, services)
+		for _, service := range services {
+			promotions = append(promotions, servicePromotion(promotionSettings, snapshots, service, time.Now()))
+		}
+		writeJSON(writer, http.StatusOK, promotions)
+	})
+
+	mux.HandleFunc("GET /promotion/{service...}", func(writer http.ResponseWriter, req *http.Request) {
+		if len(promotionSettings.Stages) == 0 {
+			writeJSON(writer, http.StatusBadRequest, apiError{Error: "no promotion pipeline, add promotion.stages to the config file"})
+			return
+		}
+		service := req.PathValue("service")
+		snapshots := pipelineSnapshots(promotionSettings, servingSnapshots(Controllers.snapshot()))
+		for _, known := range serviceKeys(snapshots) {
+			if known == service {
+				prepareOrders(req.Context(), snapshots, []string{service})
+				writeJSON(writer, http.StatusOK, servicePromotion(promotionSettings, snapshots, service, time.Now()))
+				return
+			}
+		}
+		writeJSON(writer, http.StatusNotFound, apiError{Error: "no service called " + service + " in the pipeline"})
+	})
+}
+
+// pipelineSnapshots leaves out the clusters that aren't in any stage
+func pipelineSnapshots(promotion PromotionConfig, snapshots []ClusterSnapshot) []ClusterSnapshot {
+	var pipeline []ClusterSnapshot
+	for _, snapshot := range snapshots {
+		if promotion.stageOf(snapshot) >= 0 {
+			pipeline = append(pipeline, snapshot)
+		}
+	}
+	return pipeline
+}
+
+func servicePromotion(promotion PromotionConfig, snapshots []ClusterSnapshot, service string, now time.Time) ServicePromotion {
+	order := versionOrderFor(service)
+	result := ServicePromotion{Service: service, Ordering: orderingFor(service), Containers: []ContainerPromotion{}}
+
+	stageClusters := make([][]string, len(promotion.Stages))
+	for _, snapshot := range snapshots {
+		stage := promotion.stageOf(snapshot)
+		stageClusters[stage] = append(stageClusters[stage], snapshot.ClusterName)
+	}
+
+	// the versions running right now, by container and then by versionKey
+	running := make(map[string]map[string]*VersionPromotion)
+	var names []string
+	for _, snapshot := range snapshots {
+		for _, container := range serviceContainers(snapshot, service) {
+			if running[container.Name] == nil {
+				running[container.Name] = make(map[string]*VersionPromotion)
+				names = append(names, container.Name)
+			}
+			version := container.versionKey()
+			if running[container.Name][version] == nil {
+				running[container.Name][version] = &VersionPromotion{Image: container.displayImage(), container: container}
+			}
+			running[container.Name][version].Running = appendMissing(running[container.Name][version].Running, snapshot.ClusterName)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		containerPromotion := ContainerPromotion{Name: name, Versions: []VersionPromotion{}, Skipped: []SkippedPromotion{}}
+		for version, promoted := range running[name] {
+			promoted.Stages = []StageArrival{}
+			for stage, clusters := range stageClusters {
+				var since time.Time
+				for _, cluster := range clusters {
+					if seen, ok := versionHistory.seen(cluster, service, name, version); ok && (since.IsZero() || seen.Before(since)) {
+						since = seen
+					}
+				}
+				if since.IsZero() {
+					continue
+				}
+				arrival := StageArrival{Stage: promotion.Stages[stage].Name, Since: since}
+				if len(promoted.Stages) > 0 {
+					arrival.After = formatDuration(since.Sub(promoted.Stages[len(promoted.Stages)-1].Since))
+				}
+				promoted.Stages = append(promoted.Stages, arrival)
+				promoted.Reached = arrival.Stage
+				if stage < len(promotion.Stages)-1 {
+					waitingSince := since
+					promoted.Waiting, promoted.WaitingSince = formatDuration(now.Sub(since)), &waitingSince
+				} else {
+					promoted.Waiting, promoted.WaitingSince = "", nil
+				}
+			}
+			containerPromotion.Versions = append(containerPromotion.Versions, *promoted)
+			containerPromotion.Skipped = append(containerPromotion.Skipped, skippedPromotions(promotion, stageClusters, promoted)...)
+		}
+		sortPromotions(order, containerPromotion.Versions)
+		sort.Slice(containerPromotion.Skipped, func(i, j int) bool {
+			if containerPromotion.Skipped[i].Image != containerPromotion.Skipped[j].Image {
+				return containerPromotion.Skipped[i].Image < containerPromotion.Skipped[j].Image
+			}
+			return containerPromotion.Skipped[i].Stage < containerPromotion.Skipped[j].Stage
+		})
+		result.Containers = append(result.Containers, containerPromotion)
+	}
+	return result
+}
+
+// skippedPromotions is every stage that runs the version while an earlier stage (with clusters
+// in it) never did
+func skippedPromotions(promotion PromotionConfig, stageClusters [][]string, promoted *VersionPromotion) []SkippedPromotion {
+	arrived := make(map[string]bool)
+	for _, arrival := range promoted.Stages {
+		arrived[arrival.Stage] = true
+	}
+	var skipped []SkippedPromotion
+	for stage, clusters := range stageClusters {
+		var runningHere []string
+		for _, cluster := range clusters {
+			for _, runningCluster := range promoted.Running {
+				if cluster == runningCluster {
+					runningHere = append(runningHere, cluster)
+				}
+			}
+		}
+		if len(runningHere) == 0 {
+			continue
+		}
+		var never []string
+		for earlier := 0; earlier < stage; earlier++ {
+			if len(stageClusters[earlier]) > 0 && !arrived[promotion.Stages[earlier].Name] {
+				never = append(never, promotion.Stages[earlier].Name)
+			}
+		}
+		if len(never) > 0 {
+			skipped = append(skipped, SkippedPromotion{Image: promoted.Image, Stage: promotion.Stages[stage].Name, Clusters: runningHere, Skipped: never})
+		}
+	}
+	return skipped
+}
+
+// sortPromotions puts the newest version first, the ones the order doesn't understand go last
+func sortPromotions(order versionOrder, versions []VersionPromotion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		_, iOk := order.compare(versions[i].container, versions[i].container)
+		_, jOk := order.compare(versions[j].container, versions[j].container)
+		if iOk && jOk {
+			if result, _ := order.compare(versions[i].container, versions[j].container); result != 0 {
+				return result > 0
+			}
+		} else if iOk != jOk {
+			return iOk
+		}
+		return versions[i].Image < versions[j].Image
+	})
+}
+
+func formatDuration(duration time.Duration) string {
+	return duration.Round(time.Second).String()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gr1nx-bitibt/kubetroller/imageref"
+)
+
+/*
+	Just enough of the registry API (https://distribution.github.io/distribution/spec/api/) to
+	find out when an image was built: get the manifest for the digest (picking linux/amd64 out of
+	an index), then its config blob, which has a "created" time. Only anonymous pulls are
+	supported, which covers public images and registries that let the cluster network in.
+
+	A digest always points at the same image so what we find is cached forever, failures are
+	cached for a while so a registry we can't reach doesn't get asked on every sync.
+*/
+
+const (
+	registryTimeout      = 10 * time.Second
+	registryFailureCache = 5 * time.Minute
+	// how many images get looked up at the same time
+	registryLookups = 8
+	// docker.io is the name in image references but not where the API is
+	dockerHubAPI = "registry-1.docker.io"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type registryClient struct {
+	client *http.Client
+	mutx   sync.Mutex
+	cache  map[registryImage]registryLookup
+}
+
+type registryImage struct {
+	host, repository, digest string
+}
+
+type registryLookup struct {
+	created time.Time
+	err     error
+	at      time.Time
+}
+
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+func newRegistryClient() *registryClient {
+	return &registryClient{
+		client: &http.Client{Timeout: registryTimeout},
+		cache:  make(map[registryImage]registryLookup),
+	}
+}
+
+// created is when the image with this digest was built
+func (registry *registryClient) created(ctx context.Context, image registryImage) (time.Time, error) {
+	if lookup, cached := registry.cached(image); cached && lookup.fresh() {
+		return lookup.created, lookup.err
+	}
+
+	created, err := registry.fetchCreated(ctx, image.host, image.repository, image.digest)
+	if err != nil && ctx.Err() != nil {
+		// we gave up waiting, that says nothing about the registry
+		return created, err
+	}
+	registry.mutx.Lock()
+	registry.cache[image] = registryLookup{created: created, err: err, at: time.Now()}
+	registry.mutx.Unlock()
+	return created, err
+}
+
+// cached is the last lookup of the image, however old
+func (registry *registryClient) cached(image registryImage) (registryLookup, bool) {
+	registry.mutx.Lock()
+	defer registry.mutx.Unlock()
+	lookup, cached := registry.cache[image]
+	return lookup, cached
+}
+
+// isCached is true when the image doesn't need to be looked up again
+func (registry *registryClient) isCached(image registryImage) bool {
+	lookup, cached := registry.cached(image)
+	return cached && lookup.fresh()
+}
+
+func (lookup registryLookup) fresh() bool {
+	return lookup.err == nil || time.Since(lookup.at) < registryFailureCache
+}
+
+func (registry *registryClient) fetchCreated(ctx context.Context, host, repository, digest string) (time.Time, error) {
+	var manifest registryManifest
+	if err := registry.get(ctx, host, repository, "manifests/"+digest, &manifest); err != nil {
+		return time.Time{}, err
+	}
+
+	// an index (multi arch image) points at one manifest per platform, they were all built together
+	if len(manifest.Manifests) > 0 {
+		platform := manifest.Manifests[0].Digest
+		for _, entry := range manifest.Manifests {
+			if entry.Platform.OS == "linux" && entry.Platform.Architecture == "amd64" {
+				platform = entry.Digest
+				break
+			}
+		}
+		manifest = registryManifest{}
+		if err := registry.get(ctx, host, repository, "manifests/"+platform, &manifest); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if manifest.Config.Digest == "" {
+		return time.Time{}, fmt.Errorf("manifest %s of %s/%s has no config", digest, host, repository)
+	}
+
+	var config struct {
+		Created time.Time `json:"created"`
+	}
+	if err := registry.get(ctx, host, repository, "blobs/"+manifest.Config.Digest, &config); err != nil {
+		return time.Time{}, err
+	}
+	if config.Created.IsZero() {
+		return time.Time{}, fmt.Errorf("image %s of %s/%s doesn't say when it was built", digest, host, repository)
+	}
+	return config.Created, nil
+}
+
+// get fetches a registry API path into value, getting an anonymous token first if the registry wants one
+func (registry *registryClient) get(ctx context.Context, host, repository, path string, value interface{}) error {
+	apiHost := host
+	if host == imageref.DefaultRegistry {
+		apiHost = dockerHubAPI
+	}
+	scheme := "https"
+	if strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		scheme = "http"
+	}
+	target := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, apiHost, repository, path)
+
+	response, err := registry.do(ctx, target, "")
+	if err != nil {
+		return err
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+		response.Body.Close()
+		token, err := registry.token(ctx, challenge)
+		if err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+		if response, err = registry.do(ctx, target, token); err != nil {
+			return err
+		}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", target, response.Status)
+	}
+	// configs are small, manifests too, anything huge isn't what we asked for
+	return json.NewDecoder(io.LimitReader(response.Body, 4<<20)).Decode(value)
+}
+
+func (registry *registryClient) do(ctx context.Context, target, token string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return registry.client.Do(request)
+}
+
+// token gets an anonymous pull token from the auth server a Bearer challenge points at
+func (registry *registryClient) token(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errors.New("registry wants credentials, only anonymous pulls are supported")
+	}
+
+	values := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		if key, value, found := strings.Cut(strings.TrimSpace(param), "="); found {
+			values[key] = strings.Trim(value, `"`)
+		}
+	}
+	realm, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return "", fmt.Errorf("registry sent a challenge without a usable realm: %q", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if values[key] != "" {
+			query.Set(key, values[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := registry.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting a token from %s: %s", realm.Host, response.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("%s didn't send a token", realm.Host)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+/*
+	The config watcher lets the clusters from -config (or -clusters / -discover-contexts) change
+	without a restart. It polls instead of using inotify because kubeconfigs and config files
+	usually get mounted from ConfigMaps and Secrets, which swap symlinks around in a way file
+	watchers tend to miss. Every poll hashes the config file and every kubeconfig it points at,
+	and when anything changed it loads the config again and makes the running clusters match:
+	new clusters get started, removed ones get stopped and changed ones (including rotated
+	kubeconfig credentials) get restarted, and the same goes for the git sources. Only clusters
+	that came from the config are touched, the ones from the hub or the admin API are left alone.
+*/
+
+type configWatcher struct {
+	load       func() (*FileConfig, error)
+	configFile string
+	files      []string
+	lastHash   string
+	interval   time.Duration
+}
+
+func newConfigWatcher(load func() (*FileConfig, error), configFile string, current *FileConfig, interval time.Duration) *configWatcher {
+	watcher := &configWatcher{load: load, configFile: configFile, interval: interval}
+	watcher.files = watchedFiles(configFile, current)
+	watcher.lastHash = hashFiles(watcher.files)
+	return watcher
+}
+
+func (watcher *configWatcher) Run(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	logger.Info("Watching config for changes", "files", watcher.files, "interval", watcher.interval)
+	wait.UntilWithContext(ctx, watcher.poll, watcher.interval)
+}
+
+func (watcher *configWatcher) poll(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	if hash := hashFiles(watcher.files); hash == watcher.lastHash {
+		return
+	}
+
+	fileConfig, err := watcher.load()
+	if err != nil {
+		// keep running what we have, a half written file shouldn't take every cluster down
+		logger.Error(err, "Config changed but couldn't be loaded, keeping the current clusters")
+		watcher.lastHash = hashFiles(watcher.files)
+		return
+	}
+
+	watcher.files = watchedFiles(watcher.configFile, fileConfig)
+	watcher.lastHash = hashFiles(watcher.files)
+
+	logger.Info("Config changed, reconciling clusters")
+	reconcileClusters(ctx, fileConfig.Clusters, sourceConfig)
+	reconcileGitSources(ctx, fileConfig.Git)
+}
+
+// reconcileClusters starts, restarts and stops the clusters of one source so they match desired
+func reconcileClusters(ctx context.Context, desired []ClusterConfig, source string) {
+	fingerprints := make(map[string]string, len(desired))
+	configs := make(map[string]ClusterConfig, len(desired))
+	for _, config := range desired {
+		fingerprints[config.Name], configs[config.Name] = clusterFingerprint(config), config
+	}
+	reconcile(ctx, source, fingerprints, func(name string) error {
+		return Controllers.start(ctx, configs[name], source)
+	})
+}
+
+// reconcileGitSources does the same for the git sources
+func reconcileGitSources(ctx context.Context, desired []GitSourceConfig) {
+	fingerprints := make(map[string]string, len(desired))
+	configs := make(map[string]GitSourceConfig, len(desired))
+	for _, config := range desired {
+		fingerprints[config.Name], configs[config.Name] = gitFingerprint(config), config
+	}
+	reconcile(ctx, sourceGit, fingerprints, func(name string) error {
+		return Controllers.startGit(ctx, configs[name])
+	})
+}
+
+// reconcile makes what the source is running match desired, a name and fingerprint for each
+func reconcile(ctx context.Context, source string, desired map[string]string, start func(name string) error) {
+	logger := klog.FromContext(ctx)
+	running := Controllers.bySource(source)
+
+	// removals first, so a name that moved from one source to another is free again
+	for name := range running {
+		if _, wanted := desired[name]; !wanted {
+			logger.Info("Cluster removed from the config, stopping it", "cluster", name)
+			Controllers.remove(name)
+		}
+	}
+
+	for name, fingerprint := range desired {
+		runningFingerprint, exists := running[name]
+		if exists && runningFingerprint == fingerprint {
+			continue
+		}
+
+		if exists {
+			logger.Info("Cluster config changed, restarting it", "cluster", name)
+			Controllers.stop(name)
+		} else {
+			logger.Info("Cluster added to the config, starting it", "cluster", name)
+		}
+		if err := start(name); err != nil {
+			logger.Error(err, "Couldn't start cluster", "cluster", name)
+		}
+	}
+}
+
+// clusterFingerprint changes whenever anything that would need the controller to be rebuilt does,
+// which includes the contents of the kubeconfig and not just its path
+func clusterFingerprint(config ClusterConfig) string {
+	hash := sha256.New()
+	bytes, _ := json.Marshal(config)
+	hash.Write(bytes)
+	for _, path := range kubeconfigFiles(config) {
+		fmt.Fprintf(hash, "\x00%s\x00", path)
+		if contents, err := os.ReadFile(path); err == nil {
+			hash.Write(contents)
+		}
+	}
+	if config.rest != nil {
+		fmt.Fprintf(hash, "\x00%s\x00%s\x00", config.rest.Host, config.rest.BearerToken)
+		hash.Write(config.rest.CAData)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// gitFingerprint is the whole config, the source reads the repo again every interval anyway
+func gitFingerprint(config GitSourceConfig) string {
+	bytes, _ := json.Marshal(config)
+	hash := sha256.Sum256(bytes)
+	return hex.EncodeToString(hash[:])
+}
+
+// kubeconfigFiles is every file the cluster's client config gets loaded from
+func kubeconfigFiles(config ClusterConfig) []string {
+	if config.rest != nil {
+		return nil
+	}
+	if config.Kubeconfig != "" {
+		return []string{config.Kubeconfig}
+	}
+	if len(config.kubeconfigPaths) > 0 {
+		return config.kubeconfigPaths
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	return rules.GetLoadingPrecedence()
+}
+
+func watchedFiles(configFile string, fileConfig *FileConfig) []string {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	add(configFile)
+	var kubeconfigs []string
+	for _, config := range fileConfig.Clusters {
+		kubeconfigs = append(kubeconfigs, kubeconfigFiles(config)...)
+	}
+	if fileConfig.Discovery != nil {
+		// a new context in one of these is a new cluster
+		kubeconfigs = append(kubeconfigs, kubeconfigFiles(ClusterConfig{kubeconfigPaths: fileConfig.Discovery.Kubeconfigs})...)
+	}
+	sort.Strings(kubeconfigs)
+	for _, path := range kubeconfigs {
+		add(path)
+	}
+	return files
+}
+
+func hashFiles(files []string) string {
+	hash := sha256.New()
+	for _, path := range files {
+		fmt.Fprintf(hash, "\x00%s\x00", path)
+		if contents, err := os.ReadFile(path); err == nil {
+			hash.Write(contents)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
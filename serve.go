@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 )
@@ -14,12 +15,34 @@ func getClusterInfo(writer http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func serve() {
+func serve(ctx context.Context, listenAddress, probeAddress string) {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", getClusterInfo)
+	mux.HandleFunc("GET /drift", getDrift)
+	mux.HandleFunc("GET /compliance", getCompliance)
+	registerAdminHandlers(ctx, mux)
+	registerVersionHandlers(mux)
+	registerPromotionHandlers(mux)
+	registerHistoryHandlers(mux)
+	registerAPIHandlers(mux)
+	registerMetricsHandler(mux)
+	registerHealthHandlers(mux)
 
-	if err := http.ListenAndServe("localhost:8082", mux); err != nil {
+	// the health checks and metrics get a listener of their own so the kubelet and Prometheus
+	// can reach them from outside the pod without the admin API being reachable too
+	if probeAddress != "" {
+		probeMux := http.NewServeMux()
+		registerMetricsHandler(probeMux)
+		registerHealthHandlers(probeMux)
+		go func() {
+			if err := http.ListenAndServe(probeAddress, probeMux); err != nil {
+				fmt.Printf("Error while trying to start the probe listener!! Error: %s\n", err.Error())
+			}
+		}()
+	}
+
+	if err := http.ListenAndServe(listenAddress, mux); err != nil {
 		fmt.Printf("Error while trying to start API!! Error: %s\n", err.Error())
 	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+/*
+	A Source is anything that knows which workloads run which images: a live cluster (the
+	informer based Controller), a GitOps checkout (gitops.go), and later on things like snapshot
+	files or other kubetroller instances. Sources don't get read from, they tell the cluster
+	manager what changed by sending InventoryEvents, and the manager keeps the copy that the API,
+	the table, drift and the rest look at. That way adding a source is writing its Run, and
+	nothing that reads the inventory has to know where it came from.
+
+	A source sends what it has (Upsert for each workload, or one Replace) followed by Synced once
+	it's caught up, and then keeps sending changes until ctx is done. Events sent after ctx is
+	done are dropped, so a source never blocks on a manager that has stopped listening.
+*/
+
+const (
+	// the workload was added or changed
+	InventoryUpsert = "upsert"
+	InventoryDelete = "delete"
+	// Workloads is everything the source has, anything not in it is gone
+	InventoryReplace = "replace"
+	// the source has sent everything it had when it started
+	InventorySynced = "synced"
+	// the source could reach what it reads from, or couldn't when Err is set (see health.go)
+	InventoryHealth = "health"
+)
+
+type InventoryEvent struct {
+	Type      string
+	Key       WorkloadKey
+	Workload  DeployConfigs
+	Workloads map[WorkloadKey]DeployConfigs
+	Err       error
+	// what the source is reading from, like the API server's version
+	Version string
+}
+
+type Source interface {
+	// Name is what the source is called next to the clusters, it has to be unique
+	Name() string
+	Labels() map[string]string
+	// Run sends the source's inventory to events until ctx is done. It returns an error when the
+	// source can't carry on.
+	Run(ctx context.Context, events chan<- InventoryEvent) error
+}
+
+// sources that have something to clean up once they're stopped and Run has returned
+type shutdowner interface {
+	shutdown()
+}
+
+// sendEvent sends the event unless ctx is done first
+func sendEvent(ctx context.Context, events chan<- InventoryEvent, event InventoryEvent) {
+	select {
+	case events <- event:
+	case <-ctx.Done():
+	}
+}
+
+// applyEvents keeps the cluster's workloads up to date with the events until ctx is done, and
+// closes synced when the source says it's caught up
+func applyEvents(ctx context.Context, name string, events <-chan InventoryEvent, cluster *managedCluster, synced chan struct{}) {
+	workloads := cluster.workloads
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if event.Type != InventorySynced && event.Type != InventoryHealth {
+				cluster.lastEvent.Store(time.Now().UnixNano())
+			}
+			switch event.Type {
+			case InventoryHealth:
+				cluster.health.report(event.Err, event.Version, time.Now())
+			case InventoryUpsert:
+				previous, existed := workloads.get(event.Key)
+				workloads.put(event.Key, event.Workload)
+				versionHistory.observe(name, event.Key, event.Workload.Containers, time.Now())
+				publishChange(name, event.Key, previous, existed, event.Workload, true)
+			case InventoryDelete:
+				if previous, existed := workloads.remove(event.Key); existed {
+					versionHistory.deleted(name, event.Key, !workloads.hasService(serviceKey(event.Key)), time.Now())
+					publishChange(name, event.Key, previous, true, DeployConfigs{}, false)
+				}
+			case InventoryReplace:
+				now := time.Now()
+				before := workloads.snapshot()
+				for key, previous := range before {
+					if _, exists := event.Workloads[key]; !exists {
+						versionHistory.deleted(name, key, !hasService(event.Workloads, serviceKey(key)), now)
+						publishChange(name, key, previous, true, DeployConfigs{}, false)
+					}
+				}
+				workloads.replace(event.Workloads)
+				for key, config := range event.Workloads {
+					versionHistory.observe(name, key, config.Containers, now)
+					previous, existed := before[key]
+					publishChange(name, key, previous, existed, config, true)
+				}
+			case InventorySynced:
+				select {
+				case <-synced:
+				default:
+					close(synced)
+					present := make(map[WorkloadKey]bool)
+					for key := range workloads.snapshot() {
+						present[key] = true
+					}
+					versionHistory.synced(name, present, time.Now())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+	The deployments map used to be written from the informer callbacks and the workers and read
+	by the HTTP handler all at the same time with no locking, which is a data race that takes the
+	whole process down under load. Everything goes through the store now: writes take the lock,
+	and readers get a copy (a snapshot) so they never hold the lock while they build JSON or HTML
+	and never see a half written cluster.
+*/
+
+type WorkloadStore struct {
+	workloads map[WorkloadKey]DeployConfigs
+	mutx      sync.RWMutex
+	// called with every change while the lock is held, so whoever listens sees them in order
+	notify func(event InventoryEvent)
+}
+
+// ClusterSnapshot is a point in time copy of one cluster's workloads
+type ClusterSnapshot struct {
+	ClusterName string
+	Labels      map[string]string
+	Workloads   map[WorkloadKey]DeployConfigs
+	// how the cluster is doing (see health.go), an unavailable one has no workloads
+	State     string
+	LastError string
+}
+
+// servingSnapshots leaves out the unavailable clusters, for comparing versions across clusters
+// where a cluster without workloads would look like it's missing every service
+func servingSnapshots(snapshots []ClusterSnapshot) []ClusterSnapshot {
+	serving := make([]ClusterSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if snapshot.State != clusterUnavailable {
+			serving = append(serving, snapshot)
+		}
+	}
+	return serving
+}
+
+func newWorkloadStore() *WorkloadStore {
+	return &WorkloadStore{workloads: make(map[WorkloadKey]DeployConfigs)}
+}
+
+// add stores the workload if it isn't there yet and says whether it was new
+func (store *WorkloadStore) add(key WorkloadKey, config DeployConfigs) bool {
+	store.mutx.Lock()
+	defer store.mutx.Unlock()
+	if _, exists := store.workloads[key]; exists {
+		return false
+	}
+	store.workloads[key] = config
+	store.changed(InventoryEvent{Type: InventoryUpsert, Key: key, Workload: config})
+	return true
+}
+
+// put stores the workload whether or not it was there before
+func (store *WorkloadStore) put(key WorkloadKey, config DeployConfigs) {
+	store.mutx.Lock()
+	defer store.mutx.Unlock()
+	store.workloads[key] = config
+	store.changed(InventoryEvent{Type: InventoryUpsert, Key: key, Workload: config})
+}
+
+// update changes a workload that's already there. It does nothing (and returns false)
+// if the workload got removed in the meantime so a late sync can't bring it back.
+func (store *WorkloadStore) update(key WorkloadKey, change func(config *DeployConfigs)) bool {
+	store.mutx.Lock()
+	defer store.mutx.Unlock()
+	config, exists := store.workloads[key]
+	if !exists {
+		return false
+	}
+	change(&config)
+	store.workloads[key] = config
+	store.changed(InventoryEvent{Type: InventoryUpsert, Key: key, Workload: config})
+	return true
+}
+
+func (store *WorkloadStore) remove(key WorkloadKey) (DeployConfigs, bool) {
+	store.mutx.Lock()
+	defer store.mutx.Unlock()
+	config, exists := store.workloads[key]
+	if exists {
+		delete(store.workloads, key)
+		store.changed(InventoryEvent{Type: InventoryDelete, Key: key})
+	}
+	return config, exists
+}
+
+func (store *WorkloadStore) changed(event InventoryEvent) {
+	if store.notify != nil {
+		store.notify(event)
+	}
+}
+
+func (store *WorkloadStore) get(key WorkloadKey) (DeployConfigs, bool) {
+	store.mutx.RLock()
+	defer store.mutx.RUnlock()
+	config, exists := store.workloads[key]
+	return config, exists
+}
+
+// replace swaps everything in the store for workloads, for sources that read everything at once
+func (store *WorkloadStore) replace(workloads map[WorkloadKey]DeployConfigs) {
+	store.mutx.Lock()
+	defer store.mutx.Unlock()
+	store.workloads = workloads
+}
+
+// hasService is whether any workload in the store goes by the service key
+func (store *WorkloadStore) hasService(service string) bool {
+	store.mutx.RLock()
+	defer store.mutx.RUnlock()
+	return hasService(store.workloads, service)
+}
+
+func hasService(workloads map[WorkloadKey]DeployConfigs, service string) bool {
+	for key := range workloads {
+		if serviceKey(key) == service {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *WorkloadStore) snapshot() map[WorkloadKey]DeployConfigs {
+	store.mutx.RLock()
+	defer store.mutx.RUnlock()
+	workloads := make(map[WorkloadKey]DeployConfigs, len(store.workloads))
+	for key, config := range store.workloads {
+		workloads[key] = config
+	}
+	return workloads
+}
+
+// sortedWorkloadKeys is the keys of a snapshot in namespace, name, then kind order
+func sortedWorkloadKeys(workloads map[WorkloadKey]DeployConfigs) []WorkloadKey {
+	keys := make([]WorkloadKey, 0, len(workloads))
+	for key := range workloads {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Namespace != keys[j].Namespace {
+			return keys[i].Namespace < keys[j].Namespace
+		}
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Kind < keys[j].Kind
+	})
+	return keys
+}
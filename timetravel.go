@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/*
+	What was running in prod at 14:05 yesterday? With a history store (see historystore.go):
+
+	GET /history?at=2026-10-17T14:05:00Z
+		the same clusters, services and containers / sends, as they were at that time
+	GET /history/changes?from=2026-10-17T00:00:00Z&to=2026-10-18T00:00:00Z
+		every version change in that range, oldest first. cluster=, namespace= and service=
+		narrow it down. from is 24h before to if it's left out, to is now.
+
+	Times are RFC 3339, or just a day (2026-10-17) for its start in UTC, so
+	from=2026-10-17&to=2026-10-18 is everything on the 17th. Both are worked out by replaying
+	the recorded changes up to the time, so they can only go back as far as the retention
+	(compaction keeps what was running at its start, not what happened before it). A version
+	change is a container whose version (see versionKey) changed, or a container that appeared
+	or went away along with its workload.
+*/
+
+const (
+	changeAdded   = "added"
+	changeChanged = "changed"
+	changeRemoved = "removed"
+
+	defaultChangesRange = 24 * time.Hour
+)
+
+type VersionChange struct {
+	Time      time.Time `json:"time"`
+	Cluster   string    `json:"cluster"`
+	Service   string    `json:"service"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Container string    `json:"container"`
+	// added, changed or removed
+	Change string `json:"change"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+func registerHistoryHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /history", getHistory)
+	mux.HandleFunc("GET /history/changes", getChanges)
+}
+
+func getHistory(writer http.ResponseWriter, req *http.Request) {
+	db := versionHistory.store()
+	if db == nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: "no history store, add history to the config file"})
+		return
+	}
+	now := time.Now()
+	at, err := parseHistoryTime(req.URL.Query().Get("at"), now)
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	if err := db.covers(at, now); err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	records, err := db.changes(time.Time{}, at.Add(time.Nanosecond))
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	writeJSON(writer, http.StatusOK, clusterInfos(historySnapshots(records, Controllers.snapshot()), at))
+}
+
+func getChanges(writer http.ResponseWriter, req *http.Request) {
+	db := versionHistory.store()
+	if db == nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: "no history store, add history to the config file"})
+		return
+	}
+	query := req.URL.Query()
+	now := time.Now()
+	to, err := parseHistoryTime(query.Get("to"), now)
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	from, err := parseHistoryTime(query.Get("from"), to.Add(-defaultChangesRange))
+	if err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	if !from.Before(to) {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: "from has to be before to"})
+		return
+	}
+	if err := db.covers(from, now); err != nil {
+		writeJSON(writer, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	// everything before from too, to know what each change changed from
+	records, err := db.changes(time.Time{}, to)
+	if err != nil {
+		writeJSON(writer, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	changes := []VersionChange{}
+	for _, change := range versionChanges(records, from) {
+		if (query.Has("cluster") && change.Cluster != query.Get("cluster")) ||
+			(query.Has("namespace") && change.Namespace != query.Get("namespace")) ||
+			(query.Has("service") && change.Service != query.Get("service")) {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	writeJSON(writer, http.StatusOK, changes)
+}
+
+func parseHistoryTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	if day, err := time.Parse(time.DateOnly, value); err == nil {
+		return day, nil
+	}
+	return time.Time{}, fmt.Errorf("%q isn't an RFC 3339 time like 2006-01-02T15:04:05Z or a day like 2006-01-02", value)
+}
+
+// covers says why the store can't answer for at, if it can't
+func (history *historyDB) covers(at, now time.Time) error {
+	if oldest := now.Add(-history.config.retention()); at.Before(oldest) {
+		return fmt.Errorf("the history only goes back %s, to %s", history.config.retention(), oldest.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// historySnapshots replays the records into the clusters as they were after the last one.
+// Clusters that are still around get their current labels.
+func historySnapshots(records []HistoryRecord, current []ClusterSnapshot) []ClusterSnapshot {
+	workloads := make(map[string]map[WorkloadKey]DeployConfigs)
+	for _, record := range records {
+		if workloads[record.Cluster] == nil {
+			workloads[record.Cluster] = make(map[WorkloadKey]DeployConfigs)
+		}
+		if record.Deleted {
+			delete(workloads[record.Cluster], record.key())
+			continue
+		}
+		workloads[record.Cluster][record.key()] = DeployConfigs{
+			Cluster:    record.Cluster,
+			Kind:       record.Kind,
+			Namespace:  record.Namespace,
+			Name:       record.Name,
+			Containers: record.containers(),
+		}
+	}
+
+	labels := make(map[string]map[string]string)
+	for _, snapshot := range current {
+		labels[snapshot.ClusterName] = snapshot.Labels
+	}
+	snapshots := []ClusterSnapshot{}
+	for cluster, clusterWorkloads := range workloads {
+		snapshots = append(snapshots, ClusterSnapshot{ClusterName: cluster, Labels: labels[cluster], Workloads: clusterWorkloads})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ClusterName < snapshots[j].ClusterName
+	})
+	return snapshots
+}
+
+// versionChanges replays the records and returns the version changes of the ones from from on
+func versionChanges(records []HistoryRecord, from time.Time) []VersionChange {
+	changes := []VersionChange{}
+	last := make(map[string][]ContainerInfo)
+	for _, record := range records {
+		workload := latestKey(record.Cluster, record.key())
+		previous := last[workload]
+		var current []ContainerInfo
+		if !record.Deleted {
+			current = record.containers()
+		}
+		last[workload] = current
+		if record.Time.Before(from) {
+			continue
+		}
+
+		change := VersionChange{
+			Time:      record.Time,
+			Cluster:   record.Cluster,
+			Service:   serviceKey(record.key()),
+			Kind:      record.Kind,
+			Namespace: record.Namespace,
+			Name:      record.Name,
+		}
+		for _, container := range current {
+			change.Container, change.From, change.To = container.Name, "", container.Image
+			before, existed := findContainer(previous, container.Name)
+			switch {
+			case !existed:
+				change.Change = changeAdded
+			case before.versionKey() != container.versionKey():
+				change.Change, change.From = changeChanged, before.Image
+			default:
+				continue
+			}
+			changes = append(changes, change)
+		}
+		for _, container := range previous {
+			if _, exists := findContainer(current, container.Name); !exists {
+				change.Container, change.Change, change.From, change.To = container.Name, changeRemoved, container.Image, ""
+				changes = append(changes, change)
+			}
+		}
+	}
+	return changes
+}
+
+func findContainer(containers []ContainerInfo, name string) (ContainerInfo, bool) {
+	for _, container := range containers {
+		if container.Name == name {
+			return container, true
+		}
+	}
+	return ContainerInfo{}, false
+}
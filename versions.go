@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+
+	"k8s.io/klog/v2"
+)
+
+/*
+	GET /versions              every service
+	GET /versions/{service}    one service, e.g. /versions/default/api (or /versions/api with serviceIdentity: name)
+
+	For each container of the service, the clusters sorted newest first by the service's ordering
+	(see ordering.go), which ones run the newest and the oldest version, and whether the last
+	change in a cluster was a downgrade. Versions the ordering can't make sense of are listed at
+	the end with rank 0.
+*/
+
+type ServiceVersions struct {
+	Service    string              `json:"service"`
+	Ordering   string              `json:"ordering"`
+	Containers []ContainerVersions `json:"containers"`
+}
+
+type ContainerVersions struct {
+	Name     string           `json:"name"`
+	Newest   []string         `json:"newest"`
+	Oldest   []string         `json:"oldest"`
+	Clusters []ClusterVersion `json:"clusters"`
+}
+
+type ClusterVersion struct {
+	Cluster   string `json:"cluster"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Image     string `json:"image"`
+	// 1 is the newest, the same version gets the same rank and 0 means it couldn't be ordered
+	Rank          int    `json:"rank"`
+	Downgraded    bool   `json:"downgraded,omitempty"`
+	PreviousImage string `json:"previousImage,omitempty"`
+
+	container ContainerInfo
+}
+
+func registerVersionHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /versions", func(writer http.ResponseWriter, req *http.Request) {
+		snapshots := servingSnapshots(Controllers.snapshot())
+		versions := []ServiceVersions{}
+		services := serviceKeys(snapshots)
+		prepareOrders(req.Context(), snapshots, services)
+		for _, service := range services {
+			versions = append(versions, serviceVersions(snapshots, service))
+		}
+		writeJSON(writer, http.StatusOK, versions)
+	})
+
+	mux.HandleFunc("GET /versions/{service...}", func(writer http.ResponseWriter, req *http.Request) {
+		service := req.PathValue("service")
+		snapshots := servingSnapshots(Controllers.snapshot())
+		for _, known := range serviceKeys(snapshots) {
+			if known == service {
+				prepareOrders(req.Context(), snapshots, []string{service})
+				writeJSON(writer, http.StatusOK, serviceVersions(snapshots, service))
+				return
+			}
+		}
+		writeJSON(writer, http.StatusNotFound, apiError{Error: "no service called " + service})
+	})
+}
+
+func serviceVersions(snapshots []ClusterSnapshot, service string) ServiceVersions {
+	result := ServiceVersions{Service: service, Ordering: orderingFor(service), Containers: []ContainerVersions{}}
+	order := versionOrderFor(service)
+
+	byContainer := make(map[string][]ClusterVersion)
+	var names []string
+	for _, snapshot := range snapshots {
+		for _, key := range sortedWorkloadKeys(snapshot.Workloads) {
+			if serviceKey(key) != service {
+				continue
+			}
+			for _, container := range snapshot.Workloads[key].Containers {
+				if _, seen := byContainer[container.Name]; !seen {
+					names = append(names, container.Name)
+				}
+				byContainer[container.Name] = append(byContainer[container.Name], ClusterVersion{
+					Cluster:       snapshot.ClusterName,
+					Kind:          key.Kind,
+					Namespace:     key.Namespace,
+					Name:          key.Name,
+					Image:         container.displayImage(),
+					Downgraded:    container.Downgraded,
+					PreviousImage: container.PreviousImage,
+					container:     container,
+				})
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		result.Containers = append(result.Containers, rankVersions(order, name, byContainer[name]))
+	}
+	return result
+}
+
+// rankVersions sorts the versions newest first and ranks them, the ones the order doesn't
+// understand go last with rank 0
+func rankVersions(order versionOrder, name string, versions []ClusterVersion) ContainerVersions {
+	var ordered, unordered []ClusterVersion
+	for _, version := range versions {
+		if _, ok := order.compare(version.container, version.container); ok {
+			ordered = append(ordered, version)
+		} else {
+			unordered = append(unordered, version)
+		}
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		result, _ := order.compare(ordered[i].container, ordered[j].container)
+		return result > 0
+	})
+	for index := range ordered {
+		ordered[index].Rank = 1
+		if index > 0 {
+			ordered[index].Rank = ordered[index-1].Rank
+			if result, _ := order.compare(ordered[index-1].container, ordered[index].container); result != 0 {
+				ordered[index].Rank++
+			}
+		}
+	}
+
+	result := ContainerVersions{Name: name, Newest: []string{}, Oldest: []string{}, Clusters: append(ordered, unordered...)}
+	if len(ordered) > 0 {
+		newest, oldest := ordered[0].Rank, ordered[len(ordered)-1].Rank
+		for _, version := range ordered {
+			if version.Rank == newest {
+				result.Newest = appendMissing(result.Newest, version.Cluster)
+			}
+			if version.Rank == oldest {
+				result.Oldest = appendMissing(result.Oldest, version.Cluster)
+			}
+		}
+	}
+	return result
+}
+
+func appendMissing(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// markDowngrades compares a workload's new containers with what they were before and flags the
+// ones that went to an older version. A container that's still on the same version keeps its flag.
+func markDowngrades(ctx context.Context, order versionOrder, previous, current []ContainerInfo) []ContainerInfo {
+	logger := klog.FromContext(ctx)
+	before := make(map[string]ContainerInfo, len(previous))
+	for _, container := range previous {
+		before[container.Name] = container
+	}
+	for index, container := range current {
+		old, existed := before[container.Name]
+		if !existed {
+			continue
+		}
+		if old.normalizedImage() == container.normalizedImage() && slices.Equal(old.Digests, container.Digests) {
+			current[index].Downgraded, current[index].PreviousImage = old.Downgraded, old.PreviousImage
+			continue
+		}
+		// only what changed gets looked up, and only once, the sync waits for it
+		prepareOrder(ctx, order, []ContainerInfo{container, old})
+		result, ok := order.compare(container, old)
+		switch {
+		case ok && result < 0:
+			current[index].Downgraded, current[index].PreviousImage = true, old.Image
+			logger.Info("Container was downgraded", "container", container.Name, "from", old.Image, "to", container.Image)
+		case ok && result == 0:
+			current[index].Downgraded, current[index].PreviousImage = old.Downgraded, old.PreviousImage
+		}
+	}
+	return current
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	GET /api/v1/watch streams what changes as Server-Sent Events, so the front end doesn't have
+	to poll /. Every event has an id, its type as the event name and a WatchEvent as the data:
+
+	id: 1760702700123456789-42
+	event: imageChanged
+	data: {"id":"1760702700123456789-42","type":"imageChanged","cluster":"prod",...}
+
+	serviceAdded        a workload showed up (once it has containers)
+	imageChanged        its containers run a different version now, previous is what they ran
+	serviceRemoved      the workload is gone
+	clusterUnreachable  the cluster's source failed, error says why. Its workloads are dropped
+	                    without a serviceRemoved each, and come back with serviceAdded once a
+	                    retry works
+	clusterRemoved      the cluster (and everything in it) isn't watched anymore
+	resync              the events since the id the client asked for aren't all kept anymore
+	                    (or it's from before the process restarted), it has to fetch everything
+	                    again
+
+	An id is when the process started and a count of the events since, the count alone starts
+	over on a restart. The last 1000 events are kept. A client that reconnects with
+	Last-Event-ID (EventSource does that on its own) or ?lastEventId= gets what it missed before
+	anything new. cluster= and service= only send the events of that cluster or service (and the
+	ones that aren't about any one service). A client that can't keep up gets disconnected and
+	can pick up from where it was by reconnecting.
+*/
+
+const (
+	watchServiceAdded       = "serviceAdded"
+	watchImageChanged       = "imageChanged"
+	watchServiceRemoved     = "serviceRemoved"
+	watchClusterUnreachable = "clusterUnreachable"
+	watchClusterRemoved     = "clusterRemoved"
+	watchResync             = "resync"
+
+	watchHistorySize = 1000
+	watchBufferSize  = 100
+	watchKeepAlive   = 30 * time.Second
+)
+
+type WatchEvent struct {
+	ID         string          `json:"id,omitempty"`
+	Type       string          `json:"type"`
+	Time       time.Time       `json:"time"`
+	Cluster    string          `json:"cluster,omitempty"`
+	Service    string          `json:"service,omitempty"`
+	Kind       string          `json:"kind,omitempty"`
+	Namespace  string          `json:"namespace,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	Containers []ContainerInfo `json:"containers,omitempty"`
+	Previous   []ContainerInfo `json:"previous,omitempty"`
+	Error      string          `json:"error,omitempty"`
+
+	seq uint64
+}
+
+// WatchHub hands every event to every watcher and keeps the last few for reconnects
+type WatchHub struct {
+	// when the hub was made, so ids from another process are never mistaken for ours
+	epoch    int64
+	lastSeq  uint64
+	recent   []WatchEvent
+	size     int
+	watchers map[chan WatchEvent]bool
+	mutx     sync.Mutex
+}
+
+var watchEvents = newWatchHub(watchHistorySize)
+
+func newWatchHub(size int) *WatchHub {
+	return &WatchHub{epoch: time.Now().UnixNano(), size: size, watchers: make(map[chan WatchEvent]bool)}
+}
+
+func (hub *WatchHub) publish(event WatchEvent) {
+	hub.mutx.Lock()
+	defer hub.mutx.Unlock()
+	hub.lastSeq++
+	event.seq, event.ID = hub.lastSeq, fmt.Sprintf("%d-%d", hub.epoch, hub.lastSeq)
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	hub.recent = append(hub.recent, event)
+	if len(hub.recent) > hub.size {
+		hub.recent = hub.recent[len(hub.recent)-hub.size:]
+	}
+	for watcher := range hub.watchers {
+		select {
+		case watcher <- event:
+		default:
+			// too slow, it can reconnect with the last id it got
+			delete(hub.watchers, watcher)
+			close(watcher)
+		}
+	}
+}
+
+// subscribe returns a channel with every event from now on, and what was missed since the
+// event lastEventID. complete is false when that can't be worked out anymore and the client has
+// to resync.
+func (hub *WatchHub) subscribe(lastEventID string) (chan WatchEvent, []WatchEvent, bool) {
+	hub.mutx.Lock()
+	defer hub.mutx.Unlock()
+	watcher := make(chan WatchEvent, watchBufferSize)
+	hub.watchers[watcher] = true
+	if lastEventID == "" {
+		return watcher, nil, true
+	}
+	epoch, lastSeq, ok := parseWatchEventID(lastEventID)
+	if !ok || epoch != hub.epoch || lastSeq > hub.lastSeq {
+		// from before a restart
+		return watcher, nil, false
+	}
+	var missed []WatchEvent
+	for _, event := range hub.recent {
+		if event.seq > lastSeq {
+			missed = append(missed, event)
+		}
+	}
+	// the one right after lastSeq has been dropped already
+	complete := lastSeq == hub.lastSeq || (len(hub.recent) > 0 && hub.recent[0].seq <= lastSeq+1)
+	return watcher, missed, complete
+}
+
+// parseWatchEventID splits an id into its epoch and count, ok is false for ids that aren't
+// ours, like the plain counts older versions sent
+func parseWatchEventID(id string) (int64, uint64, bool) {
+	epochPart, seqPart, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	epoch, epochErr := strconv.ParseInt(epochPart, 10, 64)
+	seq, seqErr := strconv.ParseUint(seqPart, 10, 64)
+	return epoch, seq, epochErr == nil && seqErr == nil
+}
+
+func (hub *WatchHub) unsubscribe(watcher chan WatchEvent) {
+	hub.mutx.Lock()
+	defer hub.mutx.Unlock()
+	if hub.watchers[watcher] {
+		delete(hub.watchers, watcher)
+		close(watcher)
+	}
+}
+
+// publishChange works out what a change to a workload means for watchers, if anything
+func publishChange(cluster string, key WorkloadKey, previous DeployConfigs, existed bool, current DeployConfigs, exists bool) {
+	event := WatchEvent{Cluster: cluster, Service: serviceKey(key), Kind: key.Kind, Namespace: key.Namespace, Name: key.Name}
+	// workloads without containers are placeholders the controller hasn't synced yet
+	had := existed && len(previous.Containers) > 0
+	has := exists && len(current.Containers) > 0
+	switch {
+	case has && !had:
+		event.Type, event.Containers = watchServiceAdded, current.Containers
+	case has && versionKeys(previous.Containers) != versionKeys(current.Containers):
+		event.Type, event.Containers, event.Previous = watchImageChanged, current.Containers, previous.Containers
+	case had && !exists:
+		event.Type, event.Previous = watchServiceRemoved, previous.Containers
+	default:
+		return
+	}
+	watchEvents.publish(event)
+}
+
+func watchAPI(writer http.ResponseWriter, req *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeJSON(writer, http.StatusInternalServerError, apiError{Error: "streaming isn't supported"})
+		return
+	}
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("lastEventId")
+	}
+	cluster, service := req.URL.Query().Get("cluster"), req.URL.Query().Get("service")
+
+	watcher, missed, complete := watchEvents.subscribe(lastEventID)
+	defer watchEvents.unsubscribe(watcher)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+
+	send := func(event WatchEvent) bool {
+		if (cluster != "" && event.Cluster != "" && event.Cluster != cluster) || (service != "" && event.Service != "" && event.Service != service) {
+			return true
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return false
+		}
+		if event.ID != "" {
+			fmt.Fprintf(writer, "id: %s\n", event.ID)
+		}
+		if _, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	if !complete {
+		send(WatchEvent{Type: watchResync, Time: time.Now()})
+	}
+	for _, event := range missed {
+		if !send(event) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event, open := <-watcher:
+			if !open || !send(event) {
+				return
+			}
+		case <-keepAlive.C:
+			// a comment, so proxies don't time the connection out
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
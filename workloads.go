@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/Gr1nx-bitibt/kubetroller/imageref"
+)
+
+/*
+	Deployments aren't the only thing that runs images. Each kind of workload we know how to
+	track has an entry here with the informer to watch it with and how to get the pod spec
+	(and so the containers) out of one. The clusters track every kind unless their config
+	says otherwise:
+
+	clusters:
+	  - name: prod
+	    kinds: [Deployment, StatefulSet, DaemonSet]
+*/
+
+const (
+	kindDeployment  = "Deployment"
+	kindStatefulSet = "StatefulSet"
+	kindDaemonSet   = "DaemonSet"
+	kindCronJob     = "CronJob"
+	kindJob         = "Job"
+)
+
+// WorkloadKey is what a workload is stored and queued under. The kind is part of it
+// because a Deployment and a StatefulSet can have the same namespace and name.
+type WorkloadKey struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (key WorkloadKey) String() string {
+	return fmt.Sprintf("%s %s/%s", key.Kind, key.Namespace, key.Name)
+}
+
+func (key WorkloadKey) objectName() cache.ObjectName {
+	return cache.ObjectName{Namespace: key.Namespace, Name: key.Name}
+}
+
+type workloadKind struct {
+	name string
+	// nil for custom resources, they're watched with a dynamic informer for gvr instead
+	informer func(factory kubeinformers.SharedInformerFactory) cache.SharedIndexInformer
+	gvr      schema.GroupVersionResource
+	// the kind that shows up in the owner references of its pods (or ReplicaSets or Jobs), the
+	// same as name for the built in kinds and whatever discovery says for custom resources
+	ownerKind string
+	podSpec   func(obj interface{}) (*corev1.PodSpec, error)
+}
+
+var workloadKinds = []workloadKind{
+	{
+		name: kindDeployment,
+		informer: func(factory kubeinformers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Apps().V1().Deployments().Informer()
+		},
+		podSpec: func(obj interface{}) (*corev1.PodSpec, error) {
+			deploy, ok := obj.(*appsv1.Deployment)
+			if !ok {
+				return nil, fmt.Errorf("expected a Deployment but got a %T", obj)
+			}
+			return &deploy.Spec.Template.Spec, nil
+		},
+	},
+	{
+		name: kindStatefulSet,
+		informer: func(factory kubeinformers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Apps().V1().StatefulSets().Informer()
+		},
+		podSpec: func(obj interface{}) (*corev1.PodSpec, error) {
+			statefulSet, ok := obj.(*appsv1.StatefulSet)
+			if !ok {
+				return nil, fmt.Errorf("expected a StatefulSet but got a %T", obj)
+			}
+			return &statefulSet.Spec.Template.Spec, nil
+		},
+	},
+	{
+		name: kindDaemonSet,
+		informer: func(factory kubeinformers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Apps().V1().DaemonSets().Informer()
+		},
+		podSpec: func(obj interface{}) (*corev1.PodSpec, error) {
+			daemonSet, ok := obj.(*appsv1.DaemonSet)
+			if !ok {
+				return nil, fmt.Errorf("expected a DaemonSet but got a %T", obj)
+			}
+			return &daemonSet.Spec.Template.Spec, nil
+		},
+	},
+	{
+		name: kindCronJob,
+		informer: func(factory kubeinformers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Batch().V1().CronJobs().Informer()
+		},
+		podSpec: func(obj interface{}) (*corev1.PodSpec, error) {
+			cronJob, ok := obj.(*batchv1.CronJob)
+			if !ok {
+				return nil, fmt.Errorf("expected a CronJob but got a %T", obj)
+			}
+			return &cronJob.Spec.JobTemplate.Spec.Template.Spec, nil
+		},
+	},
+	{
+		name: kindJob,
+		informer: func(factory kubeinformers.SharedInformerFactory) cache.SharedIndexInformer {
+			return factory.Batch().V1().Jobs().Informer()
+		},
+		podSpec: func(obj interface{}) (*corev1.PodSpec, error) {
+			job, ok := obj.(*batchv1.Job)
+			if !ok {
+				return nil, fmt.Errorf("expected a Job but got a %T", obj)
+			}
+			return &job.Spec.Template.Spec, nil
+		},
+	},
+}
+
+func findWorkloadKind(name string) (workloadKind, bool) {
+	for _, kind := range workloadKinds {
+		if kind.name == name {
+			kind.ownerKind = kind.name
+			return kind, true
+		}
+	}
+	return workloadKind{}, false
+}
+
+func workloadKindNames() []string {
+	var names []string
+	for _, kind := range workloadKinds {
+		names = append(names, kind.name)
+	}
+	return names
+}
+
+func validateKinds(kinds []string) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for index, kind := range kinds {
+		if _, exists := findWorkloadKind(kind); !exists {
+			problems = append(problems, fmt.Sprintf("kinds[%d] %q isn't a kind we can track, use one of %s", index, kind, strings.Join(workloadKindNames(), ", ")))
+		}
+		if seen[kind] {
+			problems = append(problems, fmt.Sprintf("kinds[%d] %q is listed more than once", index, kind))
+		}
+		seen[kind] = true
+	}
+	return problems
+}
+
+// kinds is the kinds this cluster tracks, every one of them if the config doesn't say
+func (config *ClusterConfig) kinds() []string {
+	if len(config.Kinds) == 0 {
+		return workloadKindNames()
+	}
+	return config.Kinds
+}
+
+// containerInfos lists the containers of a pod spec, init containers first since they run first
+func containerInfos(podSpec *corev1.PodSpec) []ContainerInfo {
+	containers := make([]ContainerInfo, 0, len(podSpec.InitContainers)+len(podSpec.Containers)+len(podSpec.EphemeralContainers))
+	for _, container := range podSpec.InitContainers {
+		containers = append(containers, newContainerInfo(container.Name, container.Image, true, false))
+	}
+	for _, container := range podSpec.Containers {
+		containers = append(containers, newContainerInfo(container.Name, container.Image, false, false))
+	}
+	for _, container := range podSpec.EphemeralContainers {
+		containers = append(containers, newContainerInfo(container.Name, container.Image, false, true))
+	}
+	return containers
+}
+
+func newContainerInfo(name, image string, init, ephemeral bool) ContainerInfo {
+	container := ContainerInfo{Name: name, Image: image, Init: init, Ephemeral: ephemeral}
+	if ref, err := imageref.Parse(image); err == nil {
+		container.Reference = &ref
+	} else {
+		klog.V(4).InfoS("Couldn't parse image", "image", image, "err", err)
+	}
+	return container
+}
+
+// normalizedImage is what images are compared by, so nginx and docker.io/library/nginx:latest
+// match, and so do images pulled through a mirror (see images.go)
+func (container ContainerInfo) normalizedImage() string {
+	if canonical := container.canonicalReference(); canonical != nil {
+		return canonical.String()
+	}
+	return container.Image
+}
+
+// displayImage is the short form of the image for showing to people
+func (container ContainerInfo) displayImage() string {
+	if canonical := container.canonicalReference(); canonical != nil {
+		return canonical.Familiar()
+	}
+	return container.Image
+}
+
+// ownedByCronJob is for Jobs that a CronJob made. When the CronJob is tracked it already
+// covers them, and they'd just pile up as a new "service" every time the schedule fires.
+func ownedByCronJob(obj interface{}) bool {
+	object, err := metaObject(obj)
+	if err != nil {
+		return false
+	}
+	for _, owner := range object.GetOwnerReferences() {
+		if owner.Kind == kindCronJob {
+			return true
+		}
+	}
+	return false
+}
+
+func metaObject(obj interface{}) (v1.Object, error) {
+	object, ok := obj.(v1.Object)
+	if !ok {
+		return nil, fmt.Errorf("%T isn't a kubernetes object", obj)
+	}
+	return object, nil
+}